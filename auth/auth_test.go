@@ -0,0 +1,168 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	jwt "github.com/golang-jwt/jwt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/auth"
+	"github.com/superscale/spire/mqtt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func connectPacket(username, password string) *packets.ConnectPacket {
+	pkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	pkg.Username = username
+	pkg.UsernameFlag = len(username) > 0
+	pkg.Password = []byte(password)
+	pkg.PasswordFlag = len(password) > 0
+	return pkg
+}
+
+var _ = Describe("Authenticators", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "spire-auth")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	Describe("Static", func() {
+		var static *auth.Static
+
+		BeforeEach(func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+			Expect(err).NotTo(HaveOccurred())
+
+			file := filepath.Join(dir, "users.json")
+			users := `[{"username": "matriarch", "password": "` + string(hash) + `", "publish": ["armada/+/ota/#"], "subscribe": ["pylon/#"]}]`
+			Expect(os.WriteFile(file, []byte(users), 0600)).NotTo(HaveOccurred())
+
+			static, err = auth.NewStatic(file)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("returns the user with its ACLs", func() {
+			user, err := static.Authenticate(connectPacket("matriarch", "hunter2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("matriarch"))
+			Expect(user.Publish).To(Equal([]string{"armada/+/ota/#"}))
+			Expect(user.Subscribe).To(Equal([]string{"pylon/#"}))
+		})
+		It("refuses a wrong password", func() {
+			_, err := static.Authenticate(connectPacket("matriarch", "hunter3"))
+			Expect(err).To(Equal(mqtt.ErrBadCredentials))
+		})
+		It("refuses unknown users", func() {
+			_, err := static.Authenticate(connectPacket("zeratul", "hunter2"))
+			Expect(err).To(Equal(mqtt.ErrBadCredentials))
+		})
+	})
+	Describe("JWT", func() {
+		var key *ecdsa.PrivateKey
+		var jwtAuth *auth.JWT
+		var claims auth.Claims
+
+		sign := func(c auth.Claims) string {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodES256, c).SignedString(key)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		BeforeEach(func() {
+			var err error
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			Expect(err).NotTo(HaveOccurred())
+
+			file := filepath.Join(dir, "key.pem")
+			Expect(os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)).NotTo(HaveOccurred())
+
+			jwtAuth, err = auth.NewJWT(file)
+			Expect(err).NotTo(HaveOccurred())
+
+			claims = auth.Claims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:   "matriarch",
+					ExpiresAt: time.Now().Add(time.Hour).Unix(),
+				},
+				Publish:   []string{"armada/#"},
+				Subscribe: []string{"pylon/+/up"},
+			}
+		})
+		It("returns the user from the token claims", func() {
+			user, err := jwtAuth.Authenticate(connectPacket("", sign(claims)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("matriarch"))
+			Expect(user.Publish).To(Equal([]string{"armada/#"}))
+			Expect(user.Subscribe).To(Equal([]string{"pylon/+/up"}))
+		})
+		It("refuses expired tokens", func() {
+			claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+			_, err := jwtAuth.Authenticate(connectPacket("", sign(claims)))
+			Expect(err).To(Equal(mqtt.ErrBadCredentials))
+		})
+		It("refuses tokens signed with another key", func() {
+			token := sign(claims)
+
+			var err error
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = jwtAuth.Authenticate(connectPacket("", sign(claims)))
+			Expect(err).To(Equal(mqtt.ErrBadCredentials))
+
+			_, err = jwtAuth.Authenticate(connectPacket("", token))
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("refuses a user name other than the subject", func() {
+			_, err := jwtAuth.Authenticate(connectPacket("zeratul", sign(claims)))
+			Expect(err).To(Equal(mqtt.ErrNotAuthorized))
+		})
+	})
+	Describe("Chain", func() {
+		It("returns the user of the first authenticator that accepts the client", func() {
+			chain := auth.Chain{
+				staticAuthenticator{err: mqtt.ErrBadCredentials},
+				staticAuthenticator{user: &mqtt.User{Name: "matriarch"}},
+			}
+
+			user, err := chain.Authenticate(connectPacket("matriarch", "hunter2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Name).To(Equal("matriarch"))
+		})
+		It("returns the error of the last authenticator", func() {
+			chain := auth.Chain{
+				staticAuthenticator{err: mqtt.ErrBadCredentials},
+				staticAuthenticator{err: mqtt.ErrNotAuthorized},
+			}
+
+			_, err := chain.Authenticate(connectPacket("matriarch", "hunter2"))
+			Expect(err).To(Equal(mqtt.ErrNotAuthorized))
+		})
+	})
+})
+
+type staticAuthenticator struct {
+	user *mqtt.User
+	err  error
+}
+
+func (a staticAuthenticator) Authenticate(*packets.ConnectPacket) (*mqtt.User, error) {
+	return a.user, a.err
+}
@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/superscale/spire/mqtt"
+)
+
+// Chain tries each authenticator in order and accepts the client if one of them does
+type Chain []mqtt.Authenticator
+
+// Authenticate implements mqtt.Authenticator. It returns the error of the last authenticator if all of them fail.
+func (c Chain) Authenticate(pkg *packets.ConnectPacket) (*mqtt.User, error) {
+	err := mqtt.ErrBadCredentials
+
+	for _, a := range c {
+		var user *mqtt.User
+		if user, err = a.Authenticate(pkg); err == nil {
+			return user, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"os"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/superscale/spire/mqtt"
+)
+
+// Claims are the claims of a token accepted by JWT. The subject is the user name.
+type Claims struct {
+	jwt.StandardClaims
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// JWT authenticates clients that send a token signed with the private key
+// corresponding to the configured public key as password
+type JWT struct {
+	key interface{}
+}
+
+// NewJWT loads an RSA or ECDSA public key in PEM format from file
+func NewJWT(file string) (*JWT, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return &JWT{key: key}, nil
+	}
+
+	if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+		return &JWT{key: key}, nil
+	}
+
+	return nil, fmt.Errorf("%s does not contain an RSA or ECDSA public key", file)
+}
+
+// Authenticate implements mqtt.Authenticator. If the client sends a user name,
+// it must match the subject of the token.
+func (j *JWT) Authenticate(pkg *packets.ConnectPacket) (*mqtt.User, error) {
+	if !pkg.PasswordFlag {
+		return nil, mqtt.ErrBadCredentials
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(string(pkg.Password), claims, j.keyFunc)
+	if err != nil {
+		return nil, mqtt.ErrBadCredentials
+	}
+
+	if len(claims.Subject) == 0 || (pkg.UsernameFlag && pkg.Username != claims.Subject) {
+		return nil, mqtt.ErrNotAuthorized
+	}
+
+	return &mqtt.User{
+		Name:      claims.Subject,
+		Publish:   claims.Publish,
+		Subscribe: claims.Subscribe,
+	}, nil
+}
+
+// keyFunc makes sure the token is signed with an algorithm matching the type of the key
+func (j *JWT) keyFunc(token *jwt.Token) (interface{}, error) {
+	var ok bool
+
+	switch j.key.(type) {
+	case *rsa.PublicKey:
+		if _, ok = token.Method.(*jwt.SigningMethodRSA); !ok {
+			_, ok = token.Method.(*jwt.SigningMethodRSAPSS)
+		}
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return j.key, nil
+}
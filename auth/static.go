@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/superscale/spire/mqtt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// StaticUser is an entry in the user file. Password is a bcrypt hash.
+type StaticUser struct {
+	mqtt.User
+	Password string `json:"password"`
+}
+
+// Static authenticates clients with the user names and passwords from a JSON file
+type Static struct {
+	users map[string]StaticUser
+}
+
+// NewStatic loads the users from file, which contains a JSON array of StaticUser objects
+func NewStatic(file string) (*Static, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := []StaticUser{}
+	if err = json.NewDecoder(f).Decode(&users); err != nil {
+		return nil, err
+	}
+
+	s := &Static{users: make(map[string]StaticUser)}
+	for _, u := range users {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+// Authenticate implements mqtt.Authenticator
+func (s *Static) Authenticate(pkg *packets.ConnectPacket) (*mqtt.User, error) {
+	u, ok := s.users[pkg.Username]
+	if !ok || !pkg.UsernameFlag || !pkg.PasswordFlag {
+		return nil, mqtt.ErrBadCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), pkg.Password); err != nil {
+		return nil, mqtt.ErrBadCredentials
+	}
+
+	user := u.User
+	return &user, nil
+}
@@ -0,0 +1,512 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/superscale/spire/monitoring"
+	"github.com/superscale/spire/mqtt"
+)
+
+const (
+	defaultClientID    = "spire-bridge"
+	defaultKeepAlive   = time.Second * 30
+	defaultBufferSize  = 1000
+	defaultMaxInflight = 100
+	maxPacketIDs       = 65535
+	defaultMinBackoff  = time.Second
+	defaultMaxBackoff  = time.Minute
+	dialTimeout        = time.Second * 10
+)
+
+var errStopped = errors.New("bridge stopped")
+
+// Options configures a Bridge. Zero values fall back to defaults.
+type Options struct {
+	Address  string
+	TLS      *tls.Config // connect over TLS if not nil
+	ClientID string
+	Username string
+	Password string
+
+	KeepAlive   time.Duration
+	BufferSize  int // number of messages kept for the upstream broker while it is unavailable
+	MaxInflight int // number of QoS 1 and QoS 2 messages sent upstream but not acknowledged; others wait in the buffer
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	Mappings []Mapping
+
+	// Dial replaces connecting to Address, e.g. to bridge to an in-process broker
+	Dial func() (net.Conn, error)
+}
+
+// Bridge forwards messages between the local broker and an upstream MQTT broker.
+// It subscribes to the local broker with the filters of the Out mappings and to the upstream
+// broker with the filters of the In mappings. Messages for the upstream broker are buffered
+// while it is unavailable. Messages with QoS 1 and QoS 2 are delivered at least once.
+// In and Out mappings must not overlap, otherwise messages are sent back and forth.
+type Bridge struct {
+	broker *mqtt.Broker
+	opts   Options
+
+	l        sync.Mutex
+	queue    []message
+	inflight map[uint16]message // message ID -> QoS 1 and QoS 2 messages sent upstream but not acknowledged
+	pending  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+}
+
+// NewBridge returns a Bridge that is subscribed to the local broker. Messages are queued until Run
+// connects to the upstream broker.
+func NewBridge(broker *mqtt.Broker, opts Options) *Bridge {
+	if len(opts.ClientID) == 0 {
+		opts.ClientID = defaultClientID
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.MaxInflight <= 0 {
+		opts.MaxInflight = defaultMaxInflight
+	}
+	if opts.MaxInflight > maxPacketIDs {
+		opts.MaxInflight = maxPacketIDs
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+
+	b := &Bridge{
+		broker:   broker,
+		opts:     opts,
+		queue:    []message{},
+		inflight: make(map[uint16]message),
+		pending:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+
+	for _, m := range opts.Mappings {
+		if m.Direction == Out {
+			broker.Subscribe(m.Filter, b)
+		}
+	}
+	return b
+}
+
+// Run keeps a connection to the upstream broker until Stop is called.
+// Failed connections are retried with exponential backoff.
+func (b *Bridge) Run() {
+	backoff := b.opts.MinBackoff
+	for {
+		connected, err := b.connect()
+		if err == errStopped {
+			return
+		}
+		log.Printf("bridge to %s: %v", b.opts.Address, err)
+
+		if connected {
+			backoff = b.opts.MinBackoff
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-b.stop:
+			return
+		}
+
+		if backoff *= 2; backoff > b.opts.MaxBackoff {
+			backoff = b.opts.MaxBackoff
+		}
+	}
+}
+
+// Stop unsubscribes from the local broker and closes the connection to the upstream broker.
+// Calling Stop more than once has no effect.
+func (b *Bridge) Stop() {
+	b.stopOnce.Do(func() {
+		for _, m := range b.opts.Mappings {
+			if m.Direction == Out {
+				b.broker.Unsubscribe(m.Filter, b)
+			}
+		}
+		close(b.stop)
+	})
+}
+
+// HandleMessage implements mqtt.Subscriber. It queues the message for the upstream broker
+// if it matches an Out mapping. The oldest message is dropped if the queue is full.
+func (b *Bridge) HandleMessage(topic string, msg interface{}) error {
+	for _, m := range b.opts.Mappings {
+		if m.Direction != Out || !m.matches(topic) {
+			continue
+		}
+
+		payload, err := encode(msg)
+		if err != nil {
+			return err
+		}
+
+		b.enqueue(message{m.rewrite(topic), payload, m.Qos})
+		return nil
+	}
+	return nil
+}
+
+func (b *Bridge) enqueue(msgs ...message) {
+	b.l.Lock()
+	b.queue = append(b.queue, msgs...)
+
+	if dropped := len(b.queue) - b.opts.BufferSize; dropped > 0 {
+		b.queue = b.queue[dropped:]
+		for i := 0; i < dropped; i++ {
+			monitoring.CountOfflineMessageDropped()
+		}
+	}
+	b.l.Unlock()
+
+	select {
+	case b.pending <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns false if the queue is empty or the next message has QoS 1 or QoS 2
+// and MaxInflight messages are waiting for acknowledgement
+func (b *Bridge) dequeue() (message, bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if len(b.queue) == 0 || (b.queue[0].qos > 0 && len(b.inflight) >= b.opts.MaxInflight) {
+		return message{}, false
+	}
+
+	m := b.queue[0]
+	b.queue = b.queue[1:]
+	return m, true
+}
+
+// requeue puts messages that were not acknowledged by the upstream broker back in front of the queue
+func (b *Bridge) requeue() {
+	b.l.Lock()
+	ids := []int{}
+	for id := range b.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	msgs := []message{}
+	for _, id := range ids {
+		msgs = append(msgs, b.inflight[uint16(id)])
+	}
+	b.inflight = make(map[uint16]message)
+	b.queue = append(msgs, b.queue...)
+	b.l.Unlock()
+
+	b.enqueue()
+}
+
+// connect runs one connection to the upstream broker. connected is true if the upstream broker accepted it.
+func (b *Bridge) connect() (connected bool, err error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+
+	u := &upstream{session: mqtt.NewSession(conn, b.opts.KeepAlive*3/2)}
+	defer u.session.Close()
+
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-b.stop:
+			u.session.Close()
+		case <-closed:
+		}
+	}()
+
+	if err = u.connect(b.opts); err != nil {
+		return false, b.stopped(err)
+	}
+	defer b.requeue()
+
+	if err = u.subscribe(b.opts.Mappings); err != nil {
+		return true, b.stopped(err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- b.readLoop(u)
+	}()
+
+	return true, b.stopped(b.writeLoop(u, readErr))
+}
+
+func (b *Bridge) dial() (net.Conn, error) {
+	if b.opts.Dial != nil {
+		return b.opts.Dial()
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if b.opts.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", b.opts.Address, b.opts.TLS)
+	}
+	return dialer.Dial("tcp", b.opts.Address)
+}
+
+// stopped replaces err with errStopped if Stop was called
+func (b *Bridge) stopped(err error) error {
+	select {
+	case <-b.stop:
+		return errStopped
+	default:
+		return err
+	}
+}
+
+// writeLoop sends queued messages and PINGREQ packets until the connection fails
+func (b *Bridge) writeLoop(u *upstream, readErr chan error) error {
+	ping := time.NewTicker(b.opts.KeepAlive)
+	defer ping.Stop()
+
+	for {
+		for {
+			m, ok := b.dequeue()
+			if !ok {
+				break
+			}
+
+			if err := b.send(u, m); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-b.pending:
+		case <-ping.C:
+			if err := u.write(packets.NewControlPacket(packets.Pingreq)); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		}
+	}
+}
+
+func (b *Bridge) send(u *upstream, m message) error {
+	pkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkg.TopicName = m.topic
+	pkg.Payload = m.payload
+	pkg.Qos = m.qos
+
+	if m.qos > 0 {
+		b.l.Lock()
+		pkg.MessageID = u.nextID(b.inflight)
+		b.inflight[pkg.MessageID] = m
+		b.l.Unlock()
+	}
+
+	err := u.write(pkg)
+	if err != nil && m.qos == 0 {
+		b.l.Lock()
+		b.queue = append([]message{m}, b.queue...)
+		b.l.Unlock()
+	}
+	return err
+}
+
+// readLoop publishes messages received from the upstream broker to the local broker
+// and handles acknowledgements of messages sent upstream
+func (b *Bridge) readLoop(u *upstream) error {
+	for {
+		pkg, err := u.session.Read()
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("connection closed by upstream broker")
+			}
+			return err
+		}
+
+		switch p := pkg.(type) {
+		case *packets.PublishPacket:
+			// QoS 2 messages redelivered before PUBREL were already published
+			if u.session.MarkReceived(p) {
+				b.publishLocal(p)
+			}
+
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				err = u.write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				err = u.write(rec)
+			}
+		case *packets.PubrelPacket:
+			err = u.release(p)
+		case *packets.PubackPacket:
+			b.acknowledge(p.MessageID)
+		case *packets.PubrecPacket:
+			rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			rel.MessageID = p.MessageID
+			err = u.write(rel)
+		case *packets.PubcompPacket:
+			b.acknowledge(p.MessageID)
+		case *packets.SubackPacket:
+			for _, code := range p.ReturnCodes {
+				if code == mqtt.SubackFailure {
+					log.Printf("bridge to %s: upstream broker refused a subscription", b.opts.Address)
+				}
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Bridge) publishLocal(p *packets.PublishPacket) {
+	for _, m := range b.opts.Mappings {
+		if m.Direction != In || !m.matches(p.TopicName) {
+			continue
+		}
+
+		if p.Retain {
+			b.broker.PublishRetained(m.rewrite(p.TopicName), p.Payload)
+		} else {
+			b.broker.Publish(m.rewrite(p.TopicName), p.Payload)
+		}
+		return
+	}
+}
+
+// acknowledge removes the message from the in-flight messages and wakes up the write loop
+func (b *Bridge) acknowledge(messageID uint16) {
+	b.l.Lock()
+	delete(b.inflight, messageID)
+	b.l.Unlock()
+
+	select {
+	case b.pending <- struct{}{}:
+	default:
+	}
+}
+
+// upstream is a client connection to the upstream broker
+type upstream struct {
+	session *mqtt.Session
+	l       sync.Mutex // serializes writes of the read and write loops
+	lastID  uint16
+}
+
+func (u *upstream) write(pkg packets.ControlPacket) error {
+	u.l.Lock()
+	defer u.l.Unlock()
+
+	return u.session.Write(pkg)
+}
+
+// release forgets the ID of the QoS 2 message and sends PUBCOMP
+func (u *upstream) release(pkg *packets.PubrelPacket) error {
+	u.l.Lock()
+	defer u.l.Unlock()
+
+	return u.session.HandlePubrel(pkg)
+}
+
+// connect sends CONNECT and waits for CONNACK
+func (u *upstream) connect(opts Options) error {
+	pkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	pkg.ClientIdentifier = opts.ClientID
+	pkg.CleanSession = true
+	pkg.Keepalive = uint16(opts.KeepAlive.Seconds())
+
+	if len(opts.Username) > 0 {
+		pkg.UsernameFlag = true
+		pkg.Username = opts.Username
+	}
+	if len(opts.Password) > 0 {
+		pkg.PasswordFlag = true
+		pkg.Password = []byte(opts.Password)
+	}
+
+	if err := u.write(pkg); err != nil {
+		return err
+	}
+
+	p, err := u.session.Read()
+	if err != nil {
+		return err
+	}
+
+	connack, ok := p.(*packets.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("expected CONNACK from upstream broker. got %v", p)
+	}
+	if connack.ReturnCode != packets.Accepted {
+		return fmt.Errorf("upstream broker refused connection: %s", packets.ConnackReturnCodes[connack.ReturnCode])
+	}
+	return nil
+}
+
+// subscribe sends a SUBSCRIBE with the filters of all In mappings. The SUBACK is handled by the read loop.
+func (u *upstream) subscribe(mappings []Mapping) error {
+	pkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	pkg.MessageID = 1
+
+	for _, m := range mappings {
+		if m.Direction == In {
+			pkg.Topics = append(pkg.Topics, m.Filter)
+			pkg.Qoss = append(pkg.Qoss, m.Qos)
+		}
+	}
+
+	if len(pkg.Topics) == 0 {
+		return nil
+	}
+	return u.write(pkg)
+}
+
+// nextID returns a message ID that is not in use. The caller must hold the lock of inflight,
+// which must have less than maxPacketIDs entries.
+func (u *upstream) nextID(inflight map[uint16]message) uint16 {
+	for {
+		u.lastID++
+		if _, used := inflight[u.lastID]; u.lastID != 0 && !used {
+			return u.lastID
+		}
+	}
+}
+
+// encode serializes the message to JSON unless it is a []byte, like mqtt.Session does
+func encode(msg interface{}) ([]byte, error) {
+	if payload, ok := msg.([]byte); ok {
+		return payload, nil
+	}
+	return json.Marshal(msg)
+}
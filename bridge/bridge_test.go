@@ -0,0 +1,281 @@
+package bridge_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/bridge"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+// upstreamBroker accepts bridge connections over pipes
+type upstreamBroker struct {
+	*mqtt.Broker
+
+	l        sync.Mutex
+	sessions []*mqtt.Session
+	refuse   int // number of connection attempts to fail
+	attempts int
+}
+
+func (u *upstreamBroker) dial() (net.Conn, error) {
+	u.l.Lock()
+	defer u.l.Unlock()
+
+	u.attempts++
+	if u.attempts <= u.refuse {
+		return nil, errors.New("connection refused")
+	}
+
+	a, b := net.Pipe()
+	session := mqtt.NewSession(a, time.Second)
+	u.sessions = append(u.sessions, session)
+
+	go u.HandleConnection(session)
+	return b, nil
+}
+
+func (u *upstreamBroker) connections() int {
+	u.l.Lock()
+	defer u.l.Unlock()
+
+	return len(u.sessions)
+}
+
+func (u *upstreamBroker) disconnect() {
+	u.l.Lock()
+	defer u.l.Unlock()
+
+	u.sessions[len(u.sessions)-1].Close()
+}
+
+var _ = Describe("Bridge", func() {
+
+	var local *mqtt.Broker
+	var upstream *upstreamBroker
+	var b *bridge.Bridge
+	var mappings []bridge.Mapping
+	var dial func() (net.Conn, error)
+	var maxInflight int
+	var remoteRecorder, localRecorder *testutils.PubSubRecorder
+
+	BeforeEach(func() {
+		local = mqtt.NewBroker(true)
+		upstream = &upstreamBroker{Broker: mqtt.NewBroker(false)}
+		dial = upstream.dial
+		maxInflight = 0
+
+		remoteRecorder = testutils.NewPubSubRecorder()
+		upstream.Subscribe("data/#", remoteRecorder)
+
+		localRecorder = testutils.NewPubSubRecorder()
+		local.Subscribe("armada/#", localRecorder)
+
+		mappings = []bridge.Mapping{
+			{Direction: bridge.Out, Filter: "matriarch/+/wan/ping", Qos: 1, LocalPrefix: "matriarch/", RemotePrefix: "data/matriarch/"},
+			{Direction: bridge.Out, Filter: "matriarch/+/stations", LocalPrefix: "matriarch/", RemotePrefix: "data/matriarch/"},
+			{Direction: bridge.In, Filter: "data/commands/#", Qos: 1, LocalPrefix: "armada/", RemotePrefix: "data/commands/"},
+		}
+	})
+	JustBeforeEach(func() {
+		b = bridge.NewBridge(local, bridge.Options{
+			Mappings:    mappings,
+			MaxInflight: maxInflight,
+			MinBackoff:  time.Millisecond * 10,
+			MaxBackoff:  time.Millisecond * 20,
+			Dial:        dial,
+		})
+		go b.Run()
+	})
+	AfterEach(func() {
+		b.Stop()
+	})
+	It("forwards local messages matching an out mapping with the remote prefix", func() {
+		local.Publish("matriarch/1.marsara/wan/ping", []byte(`{"latency":12}`))
+		local.Publish("matriarch/1.marsara/stations", map[string]int{"count": 3})
+		local.Publish("matriarch/1.marsara/up", []byte(`{}`))
+
+		Eventually(remoteRecorder.Count).Should(Equal(2))
+
+		topic, msg := remoteRecorder.First()
+		Expect(topic).To(Equal("data/matriarch/1.marsara/wan/ping"))
+		Expect(msg).To(Equal([]byte(`{"latency":12}`)))
+
+		topic, msg = remoteRecorder.Last()
+		Expect(topic).To(Equal("data/matriarch/1.marsara/stations"))
+		Expect(msg).To(Equal([]byte(`{"count":3}`)))
+
+		Consistently(remoteRecorder.Count, "20ms").Should(Equal(2))
+	})
+	It("forwards upstream messages matching an in mapping with the local prefix", func() {
+		Eventually(func() int {
+			upstream.Publish("data/commands/1.marsara/reboot", []byte(`{}`))
+			return localRecorder.Count()
+		}).Should(BeNumerically(">", 0))
+
+		topic, msg := localRecorder.First()
+		Expect(topic).To(Equal("/armada/1.marsara/reboot"))
+		Expect(msg).To(Equal([]byte(`{}`)))
+	})
+	Context("while the upstream broker is unavailable", func() {
+		BeforeEach(func() {
+			upstream.refuse = 3
+		})
+		It("buffers messages and delivers them once connected", func() {
+			local.Publish("matriarch/1.marsara/wan/ping", []byte(`1`))
+			local.Publish("matriarch/1.marsara/wan/ping", []byte(`2`))
+
+			Eventually(remoteRecorder.Count).Should(Equal(2))
+			Expect(upstream.connections()).To(Equal(1))
+
+			_, msg := remoteRecorder.First()
+			Expect(msg).To(Equal([]byte(`1`)))
+		})
+	})
+	Context("when the upstream broker does not acknowledge messages", func() {
+		var received chan *packets.PublishPacket
+
+		BeforeEach(func() {
+			maxInflight = 2
+			received = make(chan *packets.PublishPacket, 10)
+
+			dial = func() (net.Conn, error) {
+				a, b := net.Pipe()
+				go func(session *mqtt.Session, received chan<- *packets.PublishPacket) {
+					defer session.Close()
+
+					if _, err := session.ReadConnect(); err != nil {
+						return
+					}
+					if err := session.AcknowledgeConnect(false); err != nil {
+						return
+					}
+
+					for {
+						p, err := session.Read()
+						if err != nil {
+							return
+						}
+						if pubPkg, ok := p.(*packets.PublishPacket); ok {
+							received <- pubPkg
+						}
+					}
+				}(mqtt.NewSession(a, time.Second), received)
+				return b, nil
+			}
+		})
+		It("sends at most MaxInflight messages and buffers the others", func() {
+			for i := 0; i < 5; i++ {
+				local.Publish("matriarch/1.marsara/wan/ping", []byte(`{}`))
+			}
+
+			Eventually(received).Should(HaveLen(2))
+			Consistently(received).Should(HaveLen(2))
+		})
+	})
+	Context("when the upstream broker redelivers a QoS 2 message", func() {
+		var completed chan uint16
+
+		BeforeEach(func() {
+			completed = make(chan uint16, 1)
+
+			dial = func() (net.Conn, error) {
+				a, b := net.Pipe()
+				go func(session *mqtt.Session, completed chan<- uint16) {
+					defer session.Close()
+
+					if _, err := session.ReadConnect(); err != nil {
+						return
+					}
+					if err := session.AcknowledgeConnect(false); err != nil {
+						return
+					}
+
+					pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+					pub.TopicName = "data/commands/1.marsara/reboot"
+					pub.Payload = []byte(`{}`)
+					pub.Qos = 2
+					pub.MessageID = 7
+
+					// the bridge writes SUBSCRIBE and PUBREC while the PUBLISH packets are sent
+					go func(pub packets.PublishPacket) {
+						session.Write(&pub)
+						pub.Dup = true
+						session.Write(&pub)
+					}(*pub)
+
+					rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+					rel.MessageID = pub.MessageID
+					recs := 0
+
+					for {
+						p, err := session.Read()
+						if err != nil {
+							return
+						}
+						switch p := p.(type) {
+						case *packets.PubrecPacket:
+							// release the message once both deliveries were received
+							if recs++; recs < 2 {
+								continue
+							}
+							if err := session.Write(rel); err != nil {
+								return
+							}
+						case *packets.PubcompPacket:
+							completed <- p.MessageID
+						}
+					}
+				}(mqtt.NewSession(a, time.Second), completed)
+				return b, nil
+			}
+		})
+		It("publishes it only once", func() {
+			Eventually(completed).Should(Receive(Equal(uint16(7))))
+			Consistently(localRecorder.Count, "20ms").Should(Equal(1))
+		})
+	})
+	It("can be stopped more than once", func() {
+		b.Stop()
+		Expect(b.Stop).NotTo(Panic())
+	})
+	It("reconnects when the connection is lost", func() {
+		Eventually(upstream.connections).Should(Equal(1))
+		upstream.disconnect()
+		Eventually(upstream.connections).Should(Equal(2))
+
+		local.Publish("matriarch/1.marsara/wan/ping", []byte(`{}`))
+		Eventually(remoteRecorder.Count).Should(Equal(1))
+	})
+})
+
+var _ = Describe("ParseMapping", func() {
+	It("parses direction and filter", func() {
+		m, err := bridge.ParseMapping("out:matriarch/+/stations")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(Equal(bridge.Mapping{Direction: bridge.Out, Filter: "matriarch/+/stations"}))
+	})
+	It("parses QoS and prefixes", func() {
+		m, err := bridge.ParseMapping("in:data/commands/#:1:armada/:data/commands/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(Equal(bridge.Mapping{
+			Direction:    bridge.In,
+			Filter:       "data/commands/#",
+			Qos:          1,
+			LocalPrefix:  "armada/",
+			RemotePrefix: "data/commands/",
+		}))
+	})
+	It("rejects invalid mappings", func() {
+		for _, s := range []string{"", "out", "sideways:foo", "out:foo/#/bar", "out:foo:3", "out:foo:1:bar"} {
+			_, err := bridge.ParseMapping(s)
+			Expect(err).To(HaveOccurred(), s)
+		}
+	})
+})
@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/superscale/spire/mqtt"
+)
+
+// Direction determines which way messages are forwarded by a Mapping
+type Direction string
+
+const (
+	// Out forwards messages from the local broker to the upstream broker
+	Out Direction = "out"
+	// In forwards messages from the upstream broker to the local broker
+	In Direction = "in"
+)
+
+// Mapping selects the messages forwarded by the bridge. Filter is matched against topics on the
+// source broker, i.e. the local one for Out and the upstream one for In. A topic starting with the
+// prefix of the source broker gets the prefix of the destination broker instead.
+type Mapping struct {
+	Direction    Direction
+	Filter       string
+	Qos          byte
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// ParseMapping parses a mapping of the form <direction>:<filter>[:<qos>[:<local prefix>:<remote prefix>]],
+// e.g. "out:matriarch/+/stations:1:matriarch/:data/matriarch/"
+func ParseMapping(s string) (m Mapping, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 3 && len(parts) != 5 {
+		return m, fmt.Errorf("invalid bridge mapping %q", s)
+	}
+
+	m.Direction = Direction(parts[0])
+	if m.Direction != Out && m.Direction != In {
+		return m, fmt.Errorf("invalid direction in bridge mapping %q", s)
+	}
+
+	m.Filter = parts[1]
+	if !mqtt.ValidFilter(m.Filter) {
+		return m, fmt.Errorf("invalid topic filter in bridge mapping %q", s)
+	}
+
+	if len(parts) > 2 {
+		qos, err := strconv.ParseUint(parts[2], 10, 8)
+		if err != nil || qos > 2 {
+			return m, fmt.Errorf("invalid QoS in bridge mapping %q", s)
+		}
+		m.Qos = byte(qos)
+	}
+
+	if len(parts) == 5 {
+		m.LocalPrefix = parts[3]
+		m.RemotePrefix = parts[4]
+	}
+	return m, nil
+}
+
+// matches returns true if topic matches the filter of the mapping. Leading slashes are ignored.
+func (m Mapping) matches(topic string) bool {
+	return mqtt.TopicsMatch(
+		strings.Split(strings.TrimPrefix(topic, "/"), "/"),
+		strings.Split(strings.TrimPrefix(m.Filter, "/"), "/"))
+}
+
+// rewrite replaces the prefix of the source broker with the one of the destination broker
+func (m Mapping) rewrite(topic string) string {
+	from, to := m.LocalPrefix, m.RemotePrefix
+	if m.Direction == In {
+		from, to = to, from
+	}
+
+	topic = strings.TrimPrefix(topic, "/")
+	if strings.HasPrefix(topic, from) {
+		return to + strings.TrimPrefix(topic, from)
+	}
+	return topic
+}
@@ -0,0 +1,144 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Record is a message published through the broker.
+//
+// In a capture file each record is stored as a 4 byte length of the rest of the record, the timestamp
+// in nanoseconds since the Unix epoch (8 bytes), a flags byte, the listener, the client ID and the topic,
+// each prefixed with a 2 byte length, and the payload. All integers are big endian.
+// Bit 0 of the flags is set for retained messages.
+type Record struct {
+	Time     time.Time
+	Retained bool
+	Listener string
+	ClientID string
+	Topic    string
+	Payload  []byte
+}
+
+const flagRetained = 1
+
+const maxStringLength = 65535
+
+var errCorruptRecord = errors.New("corrupt capture record")
+
+// MarshalBinary ...
+func (r *Record) MarshalBinary() ([]byte, error) {
+	for _, s := range []string{r.Listener, r.ClientID, r.Topic} {
+		if len(s) > maxStringLength {
+			return nil, fmt.Errorf("capture record field too long: %d bytes", len(s))
+		}
+	}
+
+	length := 8 + 1 + 2 + len(r.Listener) + 2 + len(r.ClientID) + 2 + len(r.Topic) + len(r.Payload)
+	buf := make([]byte, 4, 4+length)
+	binary.BigEndian.PutUint32(buf, uint32(length))
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(r.Time.UnixNano()))
+	buf = append(buf, ts[:]...)
+
+	var flags byte
+	if r.Retained {
+		flags |= flagRetained
+	}
+	buf = append(buf, flags)
+
+	for _, s := range []string{r.Listener, r.ClientID, r.Topic} {
+		var n [2]byte
+		binary.BigEndian.PutUint16(n[:], uint16(len(s)))
+		buf = append(buf, n[:]...)
+		buf = append(buf, s...)
+	}
+	return append(buf, r.Payload...), nil
+}
+
+// UnmarshalBinary reads a record without its length prefix
+func (r *Record) UnmarshalBinary(buf []byte) error {
+	if len(buf) < 9 {
+		return errCorruptRecord
+	}
+	r.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf))).UTC()
+	r.Retained = buf[8]&flagRetained != 0
+	buf = buf[9:]
+
+	for _, s := range []*string{&r.Listener, &r.ClientID, &r.Topic} {
+		if len(buf) < 2 {
+			return errCorruptRecord
+		}
+
+		n := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+n {
+			return errCorruptRecord
+		}
+		*s = string(buf[2 : 2+n])
+		buf = buf[2+n:]
+	}
+
+	r.Payload = append([]byte{}, buf...)
+	return nil
+}
+
+// Reader reads records from a capture file
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader ...
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReader(r)}
+}
+
+// Next returns the next record or io.EOF at the end of the capture.
+// A record cut off by a crash of the writer is reported as io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Record, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r.r, n[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	rec := new(Record)
+	if err := rec.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Files returns the existing files of the capture at path, oldest first: the rotated files path.N to path.1, then path
+func Files(path string) []string {
+	files := []string{}
+
+	for i := 1; ; i++ {
+		name := rotatedName(path, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		files = append([]string{name}, files...)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
+
+func rotatedName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
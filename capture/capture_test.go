@@ -0,0 +1,219 @@
+package capture_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/capture"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/up"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Capture", func() {
+
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spire-capture")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "capture.bin")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readAll := func(names ...string) []*capture.Record {
+		records := []*capture.Record{}
+
+		for _, name := range names {
+			f, err := os.Open(name)
+			Expect(err).NotTo(HaveOccurred())
+
+			r := capture.NewReader(f)
+			for {
+				rec, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				records = append(records, rec)
+			}
+			f.Close()
+		}
+		return records
+	}
+
+	It("reads the records it writes", func() {
+		w, err := capture.NewWriter(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		w.Record(mqtt.ListenerDevices, "1.marsara", "pylon/1.marsara/up", []byte("raw"), false)
+		w.Record(mqtt.ListenerInternal, "", "matriarch/1.marsara/up", map[string]string{"state": "up"}, true)
+		Expect(w.Close()).To(Succeed())
+
+		records := readAll(path)
+		Expect(records).To(HaveLen(2))
+
+		Expect(records[0].Listener).To(Equal(mqtt.ListenerDevices))
+		Expect(records[0].ClientID).To(Equal("1.marsara"))
+		Expect(records[0].Topic).To(Equal("pylon/1.marsara/up"))
+		Expect(records[0].Payload).To(Equal([]byte("raw")))
+		Expect(records[0].Time).NotTo(BeZero())
+		Expect(records[0].Retained).To(BeFalse())
+
+		Expect(records[1].Listener).To(Equal(mqtt.ListenerInternal))
+		Expect(records[1].Payload).To(MatchJSON(`{"state": "up"}`))
+		Expect(records[1].Retained).To(BeTrue())
+	})
+	It("skips internal topics other than the replayed events", func() {
+		w, err := capture.NewWriter(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		w.Record(mqtt.ListenerInternal, "", mqtt.StatsTopicPrefix+"/clients/devices", 3, false)
+		w.Record(mqtt.ListenerInternal, "", "/"+devices.ConnectTopic.String(), devices.ConnectMessage{DeviceName: "1.marsara"}, false)
+		w.Record(mqtt.ListenerInternal, "", mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{"matriarch/#"}}, false)
+		Expect(w.Close()).To(Succeed())
+
+		records := readAll(path)
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Topic).To(Equal("/" + devices.ConnectTopic.String()))
+		Expect(records[1].Topic).To(Equal(mqtt.SubscribeEventTopic))
+	})
+	It("rotates files and keeps maxFiles of them", func() {
+		w, err := capture.NewWriter(path, 100, 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 10; i++ {
+			w.Record(mqtt.ListenerInternal, "", "pylon/1.marsara/up", make([]byte, 60), false)
+		}
+		Expect(w.Close()).To(Succeed())
+
+		files := capture.Files(path)
+		Expect(files).To(Equal([]string{path + ".2", path + ".1", path}))
+		Expect(readAll(files...)).To(HaveLen(3))
+	})
+	It("records messages published through the broker with the listener and client ID", func() {
+		w, err := capture.NewWriter(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		broker := mqtt.NewBroker(false)
+		broker.SetRecorder(w)
+
+		brokerSession, client := testutils.Pipe()
+		go broker.HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "dashboard"
+		Expect(client.Write(conPkg)).To(Succeed())
+		_, err = client.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pubPkg.TopicName = "armada/1.marsara/ota/cancel"
+		pubPkg.Payload = []byte("{}")
+		pubPkg.Retain = true
+		Expect(client.Write(pubPkg)).To(Succeed())
+		Expect(client.Write(packets.NewControlPacket(packets.Disconnect))).To(Succeed())
+
+		// the broker closes the connection once it has handled the packets
+		_, err = client.Read()
+		Expect(err).To(HaveOccurred())
+
+		broker.Publish("matriarch/1.marsara/up", "up")
+		Expect(w.Close()).To(Succeed())
+
+		records := readAll(path)
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Listener).To(Equal(mqtt.ListenerControl))
+		Expect(records[0].ClientID).To(Equal("dashboard"))
+		Expect(records[0].Topic).To(Equal("armada/1.marsara/ota/cancel"))
+		Expect(records[0].Retained).To(BeTrue())
+		Expect(records[1].Listener).To(Equal(mqtt.ListenerInternal))
+		Expect(records[1].Retained).To(BeFalse())
+	})
+	It("replays client messages and events, but not the messages published by handlers", func() {
+		w, err := capture.NewWriter(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		w.Record(mqtt.ListenerInternal, "", devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: "1", DeviceName: "1.marsara"}, false)
+		w.Record(mqtt.ListenerInternal, "", "matriarch/1.marsara/up", up.Message{State: up.Up}, false)
+		w.Record(mqtt.ListenerDevices, "1.marsara", "pylon/1.marsara/wan/ping", []byte("{}"), false)
+		Expect(w.Close()).To(Succeed())
+
+		broker := mqtt.NewBroker(false)
+		up.Register(broker, devices.NewFormationMap())
+
+		uiRecorder := testutils.NewPubSubRecorder()
+		deviceRecorder := testutils.NewPubSubRecorder()
+		broker.Subscribe("matriarch/1.marsara/up", uiRecorder)
+		broker.Subscribe("pylon/#", deviceRecorder)
+
+		f, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		n, err := capture.Replay(broker, capture.NewReader(f), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(2))
+
+		Expect(uiRecorder.Count()).To(Equal(1))
+		_, msg := uiRecorder.First()
+		Expect(msg.(up.Message).State).To(Equal(up.Up))
+
+		Expect(deviceRecorder.Count()).To(Equal(1))
+		_, payload := deviceRecorder.First()
+		Expect(payload).To(Equal([]byte("{}")))
+	})
+	It("replays retained messages as retained", func() {
+		w, err := capture.NewWriter(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		w.Record(mqtt.ListenerControl, "dashboard", "armada/1.marsara/config", []byte("retained"), true)
+		w.Record(mqtt.ListenerControl, "dashboard", "armada/1.marsara/ota/cancel", []byte("{}"), false)
+		Expect(w.Close()).To(Succeed())
+
+		f, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		broker := mqtt.NewBroker(false)
+		n, err := capture.Replay(broker, capture.NewReader(f), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(2))
+
+		brokerSession, client := testutils.Pipe()
+		go broker.HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "dashboard"
+		Expect(client.Write(conPkg)).To(Succeed())
+		_, err = client.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subPkg.MessageID = 1
+		subPkg.Topics = []string{"armada/#"}
+		subPkg.Qoss = []byte{0}
+		Expect(client.Write(subPkg)).To(Succeed())
+
+		_, err = client.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		pkg, err := client.Read()
+		Expect(err).NotTo(HaveOccurred())
+		pubPkg, ok := pkg.(*packets.PublishPacket)
+		Expect(ok).To(BeTrue())
+		Expect(pubPkg.TopicName).To(Equal("armada/1.marsara/config"))
+		Expect(pubPkg.Retain).To(BeTrue())
+
+		client.Close()
+	})
+})
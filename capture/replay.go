@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/mqtt"
+)
+
+// internal events that are inputs of the message handlers, with the types they are published as
+var replayedEvents = map[string]func([]byte) (interface{}, error){
+	devices.ConnectTopic.String(): func(buf []byte) (interface{}, error) {
+		var m devices.ConnectMessage
+		err := json.Unmarshal(buf, &m)
+		return m, err
+	},
+	devices.DisconnectTopic.String(): func(buf []byte) (interface{}, error) {
+		var m devices.DisconnectMessage
+		err := json.Unmarshal(buf, &m)
+		return m, err
+	},
+	mqtt.SubscribeEventTopic: func(buf []byte) (interface{}, error) {
+		var m mqtt.SubscribeMessage
+		err := json.Unmarshal(buf, &m)
+		return m, err
+	},
+}
+
+// Replay publishes the messages of a capture that entered spire from outside: messages of clients
+// and the connect, disconnect and subscribe events. Other internal messages are skipped, because
+// the handlers registered on broker publish them again. The time between messages is divided by speed;
+// a speed of 0 replays the capture as fast as possible. It returns the number of messages published.
+func Replay(broker *mqtt.Broker, r *Reader, speed float64) (int, error) {
+	var last time.Time
+	n := 0
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		message, ok := replayMessage(rec)
+		if !ok {
+			continue
+		}
+
+		if speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(last)) / speed))
+		}
+		last = rec.Time
+
+		if rec.Retained {
+			broker.PublishRetained(rec.Topic, message)
+		} else {
+			broker.Publish(rec.Topic, message)
+		}
+		n++
+	}
+}
+
+// replayMessage returns the message to publish for the record and false if it is skipped
+func replayMessage(rec *Record) (interface{}, bool) {
+	if rec.Listener != mqtt.ListenerInternal {
+		return rec.Payload, true
+	}
+
+	decode, ok := replayedEvents[strings.TrimPrefix(rec.Topic, "/")]
+	if !ok {
+		return nil, false
+	}
+
+	message, err := decode(rec.Payload)
+	if err != nil {
+		log.Printf("[replay] skipping corrupt message on %s: %v", rec.Topic, err)
+		return nil, false
+	}
+	return message, true
+}
@@ -0,0 +1,189 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superscale/spire/monitoring"
+	"github.com/superscale/spire/mqtt"
+)
+
+const defaultBufferSize = 10000
+
+// Writer writes the messages of a broker to a capture file. It implements mqtt.Recorder.
+// When the file reaches maxSize bytes it is renamed to path.1, path.1 to path.2 and so on.
+// Only maxFiles rotated files are kept.
+type Writer struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	l       sync.RWMutex
+	closed  bool
+	records chan *Record
+	done    chan struct{}
+
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+// NewWriter appends to the capture file at path. maxSize <= 0 disables rotation.
+func NewWriter(path string, maxSize int64, maxFiles int) (*Writer, error) {
+	w := &Writer{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		records:  make(chan *Record, defaultBufferSize),
+		done:     make(chan struct{}),
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	go w.writeLoop()
+	return w, nil
+}
+
+// Record queues the message for writing, with retained set for messages published as retained. Messages other than []byte are serialized to JSON.
+// Messages are dropped if the writer falls behind. Internal topics are skipped, e.g. the broker statistics,
+// except for the events Replay publishes.
+func (w *Writer) Record(listener, clientID, topic string, message interface{}, retained bool) {
+	if !recorded(topic) {
+		return
+	}
+
+	payload, ok := message.([]byte)
+	if !ok {
+		var err error
+		if payload, err = json.Marshal(message); err != nil {
+			log.Printf("[capture] cannot serialize message on %s: %v", topic, err)
+			return
+		}
+	}
+
+	rec := &Record{
+		Time:     time.Now().UTC(),
+		Retained: retained,
+		Listener: listener,
+		ClientID: clientID,
+		Topic:    topic,
+		Payload:  payload,
+	}
+
+	w.l.RLock()
+	defer w.l.RUnlock()
+
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.records <- rec:
+	default:
+		monitoring.CountMessageDropped("capture")
+	}
+}
+
+// Close writes the queued records and closes the file
+func (w *Writer) Close() error {
+	w.l.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.records)
+	}
+	w.l.Unlock()
+
+	<-w.done
+	return w.file.Close()
+}
+
+func recorded(topic string) bool {
+	topic = strings.TrimPrefix(topic, "/")
+	if !strings.HasPrefix(topic, mqtt.InternalTopicPrefix+"/") {
+		return true
+	}
+
+	_, ok := replayedEvents[topic]
+	return ok
+}
+
+func (w *Writer) writeLoop() {
+	defer close(w.done)
+
+	for rec := range w.records {
+		if err := w.write(rec); err != nil {
+			log.Println("[capture]", err)
+		}
+
+		if len(w.records) == 0 {
+			if err := w.buf.Flush(); err != nil {
+				log.Println("[capture]", err)
+			}
+		}
+	}
+}
+
+func (w *Writer) write(rec *Record) error {
+	buf, err := rec.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(buf)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.buf.Write(buf)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.buf = bufio.NewWriter(f)
+	w.size = info.Size()
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.maxFiles > 0 {
+		os.Remove(rotatedName(w.path, w.maxFiles))
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			os.Rename(rotatedName(w.path, i), rotatedName(w.path, i+1))
+		}
+		if err := os.Rename(w.path, rotatedName(w.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+
+	return w.open()
+}
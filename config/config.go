@@ -8,16 +8,64 @@ import (
 
 // Params defines all possible config params
 type Params struct {
-	Environment           string        `env:"SPIRE_ENV"  envDefault:"prod"`
-	DevicesBind           string        `env:"SPIRE_DEVICES_BIND"  envDefault:":1883"`
-	ControlBind           string        `env:"SPIRE_CONTROL_BIND"  envDefault:":1884"`
-	BugsnagKey            string        `env:"SPIRE_BUGSNAG_KEY"`
-	LiberatorBaseURL      string        `env:"SPIRE_LIBERATOR_BASE_URL"  envDefault:"https://api.superscale.io"`
-	LiberatorJWTToken     string        `env:"SPIRE_LIBERATOR_JWT_TOKEN,required"`
-	IdleConnectionTimeout time.Duration `env:"SPIRE_IDLE_CONNECTION_TIMEOUT"  envDefault:"30s"`
-	SentryDynamoDBTable   string        `env:"SPIRE_SENTRY_DYNAMODB_TABLE,required"`
-	SlashPrefixTopics     bool          `env:"SPIRE_SLASH_PREFIX_TOPICS"  envDefault:"true"`
-	StatsdAddress         string        `env:"SPIRE_STATSD_ADDRESS"`
+	Environment                string        `env:"SPIRE_ENV"  envDefault:"prod"`
+	DevicesBind                string        `env:"SPIRE_DEVICES_BIND"  envDefault:":1883"`
+	ControlBind                string        `env:"SPIRE_CONTROL_BIND"  envDefault:":1884"`
+	DevicesTLSCert             string        `env:"SPIRE_DEVICES_TLS_CERT"`
+	DevicesTLSKey              string        `env:"SPIRE_DEVICES_TLS_KEY"`
+	DevicesTLSClientCA         string        `env:"SPIRE_DEVICES_TLS_CLIENT_CA"`
+	ControlTLSCert             string        `env:"SPIRE_CONTROL_TLS_CERT"`
+	ControlTLSKey              string        `env:"SPIRE_CONTROL_TLS_KEY"`
+	DevicesAcceptRate          float64       `env:"SPIRE_DEVICES_ACCEPT_RATE"`
+	DevicesAcceptBurst         int           `env:"SPIRE_DEVICES_ACCEPT_BURST"`
+	DevicesMaxConnections      int           `env:"SPIRE_DEVICES_MAX_CONNECTIONS"`
+	DevicesMaxConnectionsPerIP int           `env:"SPIRE_DEVICES_MAX_CONNECTIONS_PER_IP"`
+	DevicesMaxHandshakes       int           `env:"SPIRE_DEVICES_MAX_HANDSHAKES"`
+	ControlAcceptRate          float64       `env:"SPIRE_CONTROL_ACCEPT_RATE"`
+	ControlAcceptBurst         int           `env:"SPIRE_CONTROL_ACCEPT_BURST"`
+	ControlMaxConnections      int           `env:"SPIRE_CONTROL_MAX_CONNECTIONS"`
+	ControlMaxConnectionsPerIP int           `env:"SPIRE_CONTROL_MAX_CONNECTIONS_PER_IP"`
+	ControlMaxHandshakes       int           `env:"SPIRE_CONTROL_MAX_HANDSHAKES"`
+	DevicesProxyProtocol       bool          `env:"SPIRE_DEVICES_PROXY_PROTOCOL"`
+	ControlProxyProtocol       bool          `env:"SPIRE_CONTROL_PROXY_PROTOCOL"`
+	ControlWebSocketBind       string        `env:"SPIRE_CONTROL_WEBSOCKET_BIND"`
+	ControlUsersFile           string        `env:"SPIRE_CONTROL_USERS_FILE"`
+	ControlJWTPublicKey        string        `env:"SPIRE_CONTROL_JWT_PUBLIC_KEY"`
+	TLSMinVersion              string        `env:"SPIRE_TLS_MIN_VERSION"  envDefault:"1.2"`
+	TLSCipherSuites            []string      `env:"SPIRE_TLS_CIPHER_SUITES"`
+	TLSReloadInterval          time.Duration `env:"SPIRE_TLS_RELOAD_INTERVAL"  envDefault:"1m"`
+	BridgeAddress              string        `env:"SPIRE_BRIDGE_ADDRESS"`
+	BridgeTLS                  bool          `env:"SPIRE_BRIDGE_TLS"`
+	BridgeClientID             string        `env:"SPIRE_BRIDGE_CLIENT_ID"  envDefault:"spire-bridge"`
+	BridgeUsername             string        `env:"SPIRE_BRIDGE_USERNAME"`
+	BridgePassword             string        `env:"SPIRE_BRIDGE_PASSWORD"`
+	BridgeTopics               []string      `env:"SPIRE_BRIDGE_TOPICS"`
+	BridgeBufferSize           int           `env:"SPIRE_BRIDGE_BUFFER_SIZE"  envDefault:"1000"`
+	BridgeMaxInflight          int           `env:"SPIRE_BRIDGE_MAX_INFLIGHT"  envDefault:"100"`
+	BugsnagKey                 string        `env:"SPIRE_BUGSNAG_KEY"`
+	CaptureFile                string        `env:"SPIRE_CAPTURE_FILE"`
+	CaptureMaxSize             int64         `env:"SPIRE_CAPTURE_MAX_SIZE"  envDefault:"104857600"`
+	CaptureMaxFiles            int           `env:"SPIRE_CAPTURE_MAX_FILES"  envDefault:"5"`
+	LiberatorBaseURL           string        `env:"SPIRE_LIBERATOR_BASE_URL"  envDefault:"https://api.superscale.io"`
+	LiberatorJWTToken          string        `env:"SPIRE_LIBERATOR_JWT_TOKEN,required"`
+	IdleConnectionTimeout      time.Duration `env:"SPIRE_IDLE_CONNECTION_TIMEOUT"  envDefault:"30s"`
+	KeepAliveMin               time.Duration `env:"SPIRE_KEEPALIVE_MIN"  envDefault:"10s"`
+	KeepAliveMax               time.Duration `env:"SPIRE_KEEPALIVE_MAX"  envDefault:"30m"`
+	WriteTimeout               time.Duration `env:"SPIRE_WRITE_TIMEOUT"  envDefault:"10s"`
+	ShutdownTimeout            time.Duration `env:"SPIRE_SHUTDOWN_TIMEOUT"  envDefault:"30s"`
+	ShutdownBatchSize          int           `env:"SPIRE_SHUTDOWN_BATCH_SIZE"  envDefault:"100"`
+	ShutdownBatchInterval      time.Duration `env:"SPIRE_SHUTDOWN_BATCH_INTERVAL"  envDefault:"1s"`
+	RPCTimeout                 time.Duration `env:"SPIRE_RPC_TIMEOUT"  envDefault:"30s"`
+	RetryInterval              time.Duration `env:"SPIRE_RETRY_INTERVAL"  envDefault:"20s"`
+	SessionExpiry              time.Duration `env:"SPIRE_SESSION_EXPIRY"  envDefault:"1h"`
+	MaxInflight                int           `env:"SPIRE_MAX_INFLIGHT"  envDefault:"100"`
+	OfflineQueueSize           int           `env:"SPIRE_OFFLINE_QUEUE_SIZE"  envDefault:"1000"`
+	QueueSize                  int           `env:"SPIRE_QUEUE_SIZE"  envDefault:"1000"`
+	QueueOverflow              string        `env:"SPIRE_QUEUE_OVERFLOW"  envDefault:"drop-oldest"`
+	SentryDynamoDBTable        string        `env:"SPIRE_SENTRY_DYNAMODB_TABLE,required"`
+	SlashPrefixTopics          bool          `env:"SPIRE_SLASH_PREFIX_TOPICS"  envDefault:"true"`
+	StatsdAddress              string        `env:"SPIRE_STATSD_ADDRESS"`
+	StatsInterval              time.Duration `env:"SPIRE_STATS_INTERVAL"  envDefault:"10s"`
 }
 
 // Config is the global handle for accessing runtime configuration
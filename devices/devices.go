@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"strings"
 
@@ -39,6 +40,8 @@ type DisconnectMessage struct {
 type Handler struct {
 	formations *FormationMap
 	broker     *mqtt.Broker
+
+	requireCertificate bool
 }
 
 // NewHandler ...
@@ -49,6 +52,12 @@ func NewHandler(formations *FormationMap, broker *mqtt.Broker) *Handler {
 	}
 }
 
+// SetRequireCertificate makes the handler refuse devices that did not present a client certificate.
+// It must be called before the handler is used.
+func (h *Handler) SetRequireCertificate(required bool) {
+	h.requireCertificate = required
+}
+
 // Topic ...
 type Topic struct {
 	Prefix     string
@@ -89,12 +98,13 @@ func ParseTopic(topic string) Topic {
 // through a predicate and returns the matches as a slice of Topic objects.
 // The predicate receives the "path" component of the topic as argument.
 // Topics with a prefix other than "matriarch" as well as those with
-// wildcards in the device name part will be skipped.
+// wildcards in the device name part will be skipped. Shared subscriptions
+// are matched without the share prefix.
 func FilterSubscribeTopics(sm mqtt.SubscribeMessage, matches func(string) bool) []Topic {
 	matchingTopics := []Topic{}
 
 	for _, topic := range sm.Topics {
-		t := ParseTopic(topic)
+		t := ParseTopic(mqtt.StripSharePrefix(topic))
 
 		if t.Prefix == "matriarch" && t.DeviceName != "+" && matches(t.Path) {
 			matchingTopics = append(matchingTopics, t)
@@ -117,12 +127,13 @@ func (h *Handler) HandleConnection(session *mqtt.Session) {
 	}
 
 	for {
-		ca, err := session.Read()
+		ca, props, err := session.ReadWithProperties()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !session.TakenOver() {
 				log.Printf("error while reading packet from %s: %v. closing connection", cm.DeviceName, err)
 			}
 
+			h.broker.PublishWill(session)
 			h.deviceDisconnected(cm.FormationID, cm.DeviceName, session)
 			return
 		}
@@ -131,13 +142,25 @@ func (h *Handler) HandleConnection(session *mqtt.Session) {
 		case *packets.PingreqPacket:
 			err = session.SendPingresp()
 		case *packets.PublishPacket:
-			h.broker.Publish(ca.TopicName, ca.Payload)
+			if session.MarkReceived(ca) && h.broker.MayPublish(session, ca.TopicName) {
+				h.broker.HandlePublishPacketFrom(session, ca, props)
+			}
+			err = session.AcknowledgePublish(ca)
+		case *packets.PubackPacket:
+			session.HandlePuback(ca)
+		case *packets.PubrecPacket:
+			err = session.HandlePubrec(ca)
+		case *packets.PubrelPacket:
+			err = session.HandlePubrel(ca)
+		case *packets.PubcompPacket:
+			session.HandlePubcomp(ca)
 		case *packets.SubscribePacket:
 			err = h.broker.HandleSubscribePacket(ca, session, false)
 		case *packets.UnsubscribePacket:
 			h.broker.UnsubscribeAll(ca, session)
-			err = session.SendUnsuback(ca.MessageID)
+			err = session.AcknowledgeUnsubscribe(ca)
 		case *packets.DisconnectPacket:
+			session.DiscardWill()
 			h.deviceDisconnected(cm.FormationID, cm.DeviceName, session)
 			return
 		default:
@@ -151,38 +174,101 @@ func (h *Handler) HandleConnection(session *mqtt.Session) {
 }
 
 func (h *Handler) connect(session *mqtt.Session) (*ConnectMessage, error) {
+	session.SetListener(mqtt.ListenerDevices)
+
 	pkg, err := session.ReadConnect()
 	if err != nil {
 		return nil, err
 	}
 
+	if strings.ContainsAny(pkg.ClientIdentifier, "/+#") || len(pkg.ClientIdentifier) == 0 {
+		monitoring.CountRejectedConnection("client_id")
+		session.RefuseConnect(packets.ErrRefusedIDRejected)
+		return nil, fmt.Errorf("invalid client ID %q from %v", pkg.ClientIdentifier, session.RemoteAddr())
+	}
+
+	if err = verifyCertificate(pkg.ClientIdentifier, session, h.requireCertificate); err != nil {
+		monitoring.CountRejectedConnection("certificate")
+		session.RefuseConnect(packets.ErrRefusedNotAuthorised)
+		return nil, err
+	}
+	session.SetUser(deviceUser(pkg.ClientIdentifier))
+
 	cm, err := buildConnectMessage(pkg, session)
 	if err != nil {
 		return nil, err
 	}
+	h.broker.Takeover(session)
 
 	h.formations.Lock()
 	h.formations.AddDevice(cm.DeviceName, cm.FormationID)
 	h.formations.Unlock()
 
-	if err = session.AcknowledgeConnect(); err != nil {
+	if err = session.AcknowledgeConnect(h.broker.SessionPresent(session)); err != nil {
+		h.broker.Remove(session)
 		return nil, err
 	}
 
 	monitoring.AddDeviceClient()
 	h.broker.Publish(ConnectTopic.String(), *cm)
+
+	if err = h.broker.Resume(session); err != nil {
+		log.Printf("error while redelivering messages to device %s: %v", cm.DeviceName, err)
+	}
 	return cm, nil
 }
 
+// deviceDisconnected publishes a DisconnectMessage unless the device has connected again
+// and the session was taken over by the new connection
 func (h *Handler) deviceDisconnected(formationID, deviceName string, session *mqtt.Session) {
 	h.broker.Remove(session)
 
-	if err := session.Close(); err != nil {
+	if err := session.Close(); err != nil && !session.TakenOver() {
 		log.Println(err)
 	}
 
 	monitoring.RemoveDeviceClient()
-	h.broker.Publish(DisconnectTopic.String(), DisconnectMessage{formationID, deviceName})
+
+	if !session.TakenOver() {
+		h.broker.Publish(DisconnectTopic.String(), DisconnectMessage{formationID, deviceName})
+	}
+}
+
+// deviceUser returns the ACLs of a device. It may only publish under pylon/<deviceName>/
+// and subscribe to its own command topics, which share the same prefix.
+func deviceUser(deviceName string) *mqtt.User {
+	topics := []string{"pylon/" + deviceName + "/#"}
+
+	return &mqtt.User{
+		Name:      deviceName,
+		Publish:   topics,
+		Subscribe: topics,
+	}
+}
+
+// verifyCertificate checks that the client certificate was issued for deviceName in either
+// its common name or a DNS SAN. Devices without a certificate are only accepted if it is not required.
+func verifyCertificate(deviceName string, session *mqtt.Session, required bool) error {
+	certs := session.PeerCertificates()
+	if len(certs) == 0 {
+		if required {
+			return fmt.Errorf("device %s at %v did not present a client certificate", deviceName, session.RemoteAddr())
+		}
+		return nil
+	}
+
+	cert := certs[0]
+	if cert.Subject.CommonName == deviceName {
+		return nil
+	}
+
+	for _, name := range cert.DNSNames {
+		if name == deviceName {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client certificate of %v was not issued for device %s", session.RemoteAddr(), deviceName)
 }
 
 func buildConnectMessage(pkg *packets.ConnectPacket, session *mqtt.Session) (cm *ConnectMessage, err error) {
@@ -195,6 +281,11 @@ func buildConnectMessage(pkg *packets.ConnectPacket, session *mqtt.Session) (cm
 		return nil, fmt.Errorf("CONNECT packet from %v is missing formation ID. closing connection", session.RemoteAddr())
 	}
 
+	// devices behind NAT don't know their public address
+	if addr, ok := session.RemoteAddr().(*net.TCPAddr); ok && len(cm.IPAddress) == 0 {
+		cm.IPAddress = addr.IP.String()
+	}
+
 	if cm.DeviceInfo, err = fetchDeviceInfo(cm.DeviceName); err != nil {
 		cm = nil
 	}
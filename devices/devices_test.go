@@ -3,12 +3,14 @@ package devices_test
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/monitoring"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -91,6 +93,88 @@ var _ = Describe("Device Message Handlers", func() {
 				Expect(cm.DeviceInfo).ToNot(BeNil())
 				Expect(cm.DeviceInfo["data"]).ToNot(BeNil())
 			})
+			Context("over TCP", func() {
+				BeforeEach(func() {
+					deviceServer, deviceClient = testutils.TCPPipe()
+				})
+				It("sets the IP address from the connection if the device did not send one", func() {
+					Eventually(recorder.Count).Should(Equal(1))
+
+					_, raw := recorder.First()
+					Expect(raw.(devices.ConnectMessage).IPAddress).To(Equal("127.0.0.1"))
+				})
+			})
+		})
+	})
+	Describe("publish with QoS 1", func() {
+		var recorder *testutils.PubSubRecorder
+		var topic = "pylon/1.marsara/wan/ping"
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(topic, recorder)
+		})
+		It("forwards the message and responds with PUBACK", func() {
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = topic
+			pubPkg.Qos = 1
+			pubPkg.MessageID = 23
+			pubPkg.Payload = []byte("{}")
+			Expect(deviceClient.Write(pubPkg)).NotTo(HaveOccurred())
+
+			p, err := deviceClient.Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			pubAck, ok := p.(*packets.PubackPacket)
+			Expect(ok).To(BeTrue())
+			Expect(pubAck.MessageID).To(Equal(uint16(23)))
+			Expect(recorder.Count()).To(Equal(1))
+		})
+	})
+	Describe("topic ACLs", func() {
+		var recorder *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe("pylon/2.korhal/#", recorder)
+			broker.Subscribe("matriarch/#", recorder)
+			broker.Subscribe("armada/#", recorder)
+			broker.Subscribe("pylon/1.marsara/#", recorder)
+		})
+		It("drops messages published outside of the device's own topics", func() {
+			for _, topic := range []string{"pylon/2.korhal/wan/ping", "matriarch/1.marsara/up", "armada/1.marsara/ota/sysupgrade", "pylon/1.marsara/wan/ping"} {
+				pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				pubPkg.TopicName = topic
+				pubPkg.Payload = []byte("{}")
+				Expect(deviceClient.Write(pubPkg)).NotTo(HaveOccurred())
+			}
+
+			Eventually(recorder.Count).Should(Equal(1))
+
+			topic, _ := recorder.First()
+			Expect(topic).To(Equal("pylon/1.marsara/wan/ping"))
+		})
+		It("refuses subscriptions to other devices' command topics", func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{"pylon/1.marsara/ota/#", "pylon/2.korhal/#", "pylon/+/ota/#"}
+			subPkg.Qoss = []byte{0, 0, 0}
+			subPkg.MessageID = 1
+			Expect(deviceClient.Write(subPkg)).NotTo(HaveOccurred())
+
+			p, err := deviceClient.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.SubackPacket).ReturnCodes).To(Equal([]byte{0, mqtt.SubackFailure, mqtt.SubackFailure}))
+		})
+		Context("with a wildcard in the client ID", func() {
+			BeforeEach(func() {
+				deviceName = "+"
+			})
+			AfterEach(func() {
+				deviceName = "1.marsara"
+			})
+			It("refuses the connection", func() {
+				Expect(response.(*packets.ConnackPacket).ReturnCode).To(BeEquivalentTo(packets.ErrRefusedIDRejected))
+			})
 		})
 	})
 	Describe("disconnect", func() {
@@ -120,6 +204,49 @@ var _ = Describe("Device Message Handlers", func() {
 				Expect(cm.DeviceName).To(Equal(deviceName))
 			})
 		})
+		Context("with a will message", func() {
+			var willRecorder *testutils.PubSubRecorder
+			var willTopic = "pylon/1.marsara/status"
+
+			BeforeEach(func() {
+				willRecorder = testutils.NewPubSubRecorder()
+				broker.Subscribe(willTopic, willRecorder)
+			})
+			JustBeforeEach(func() {
+				deviceServer, deviceClient = testutils.Pipe()
+				go devMsgHandler.HandleConnection(deviceServer)
+
+				pkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+				pkg.ClientIdentifier = deviceName
+				pkg.UsernameFlag = true
+				pkg.Username = fmt.Sprintf(`{"formation_id": "%s"}`, formationID)
+				pkg.WillFlag = true
+				pkg.WillTopic = willTopic
+				pkg.WillMessage = []byte("offline")
+				Expect(deviceClient.Write(pkg)).NotTo(HaveOccurred())
+
+				_, err := deviceClient.Read()
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("publishes the will message when the connection is lost", func() {
+				Expect(deviceClient.Close()).ToNot(HaveOccurred())
+
+				Eventually(func() int {
+					return willRecorder.Count()
+				}).Should(BeNumerically("==", 1))
+
+				_, payload := willRecorder.First()
+				Expect(payload).To(Equal([]byte("offline")))
+			})
+			It("does not publish the will message after DISCONNECT", func() {
+				Expect(deviceClient.Write(packets.NewControlPacket(packets.Disconnect))).NotTo(HaveOccurred())
+
+				Eventually(func() int {
+					return recorder.Count()
+				}).Should(BeNumerically("==", 1))
+				Expect(willRecorder.Count()).To(BeZero())
+			})
+		})
 		Context("by closing the connection", func() {
 			JustBeforeEach(func() {
 				Expect(deviceClient.Close()).ToNot(HaveOccurred())
@@ -140,6 +267,147 @@ var _ = Describe("Device Message Handlers", func() {
 			})
 		})
 	})
+	Describe("stats", func() {
+		var disconnects, recorder *testutils.PubSubRecorder
+		var publisher *mqtt.StatsPublisher
+		var before int64
+
+		BeforeEach(func() {
+			before = monitoring.Snapshot().ControlClients
+
+			disconnects = testutils.NewPubSubRecorder()
+			broker.Subscribe(devices.DisconnectTopic.String(), disconnects)
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(mqtt.StatsTopicPrefix+"/clients/control", recorder)
+
+			publisher = mqtt.NewStatsPublisher(broker, time.Millisecond*10)
+			go publisher.Run()
+		})
+		AfterEach(func() {
+			publisher.Stop()
+		})
+		It("does not count devices that disconnect as control clients", func() {
+			Expect(deviceClient.Close()).ToNot(HaveOccurred())
+			Eventually(disconnects.Count).Should(Equal(1))
+
+			published := recorder.Count()
+			Eventually(recorder.Count).Should(BeNumerically(">", published))
+
+			_, value := recorder.Last()
+			Expect(value).To(Equal(before))
+		})
+	})
+	Describe("reconnect with the same client ID", func() {
+		var recorder *testutils.PubSubRecorder
+		var newServer, newClient *mqtt.Session
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(devices.DisconnectTopic.String(), recorder)
+		})
+		JustBeforeEach(func() {
+			newServer, newClient = testutils.Pipe()
+			go devMsgHandler.HandleConnection(newServer)
+
+			Expect(testutils.WriteConnectPacket(formationID, deviceName, "", newClient)).NotTo(HaveOccurred())
+
+			_, err := newClient.Read()
+			Expect(err).NotTo(HaveOccurred())
+		})
+		AfterEach(func() {
+			newClient.Close()
+		})
+		It("closes the previous connection", func() {
+			_, err := deviceClient.Read()
+			Expect(err).To(HaveOccurred())
+		})
+		It("does not publish a disconnect message for the previous connection", func() {
+			Consistently(func() int {
+				return recorder.Count()
+			}, "50ms").Should(BeZero())
+		})
+		It("publishes a disconnect message when the new connection is closed", func() {
+			Expect(newClient.Close()).NotTo(HaveOccurred())
+
+			Eventually(func() int {
+				return recorder.Count()
+			}).Should(BeNumerically("==", 1))
+		})
+	})
+	Describe("control client with the client ID of the device", func() {
+		var recorder *testutils.PubSubRecorder
+		var controlServer, controlClient *mqtt.Session
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(devices.DisconnectTopic.String(), recorder)
+		})
+		JustBeforeEach(func() {
+			controlServer, controlClient = testutils.Pipe()
+			go broker.HandleConnection(controlServer)
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = deviceName
+			Expect(controlClient.Write(conPkg)).NotTo(HaveOccurred())
+
+			_, err := controlClient.Read()
+			Expect(err).NotTo(HaveOccurred())
+		})
+		AfterEach(func() {
+			controlClient.Close()
+		})
+		It("does not close the connection of the device", func() {
+			Expect(deviceClient.Write(packets.NewControlPacket(packets.Pingreq))).NotTo(HaveOccurred())
+
+			pkg, err := deviceClient.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pkg).To(BeAssignableToTypeOf(&packets.PingrespPacket{}))
+			Expect(deviceServer.TakenOver()).To(BeFalse())
+		})
+		It("publishes a disconnect message when the device disconnects", func() {
+			Expect(deviceClient.Close()).NotTo(HaveOccurred())
+
+			Eventually(recorder.Count).Should(Equal(1))
+		})
+	})
+	Describe("client certificate", func() {
+		BeforeEach(func() {
+			deviceServer, deviceClient = testutils.TLSPipe(deviceName)
+		})
+		It("accepts a certificate issued for the device", func() {
+			Expect(response.(*packets.ConnackPacket).ReturnCode).To(BeEquivalentTo(packets.Accepted))
+		})
+		Context("issued for another device", func() {
+			BeforeEach(func() {
+				deviceServer, deviceClient = testutils.TLSPipe("2.korhal")
+			})
+			It("refuses the connection", func() {
+				Expect(response.(*packets.ConnackPacket).ReturnCode).To(BeEquivalentTo(packets.ErrRefusedNotAuthorised))
+
+				_, err := deviceClient.Read()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Context("when it is required", func() {
+			BeforeEach(func() {
+				devMsgHandler.SetRequireCertificate(true)
+			})
+			It("accepts a certificate issued for the device", func() {
+				Expect(response.(*packets.ConnackPacket).ReturnCode).To(BeEquivalentTo(packets.Accepted))
+			})
+			Context("and the device presents none", func() {
+				BeforeEach(func() {
+					deviceServer, deviceClient = testutils.Pipe()
+				})
+				It("refuses the connection", func() {
+					Expect(response.(*packets.ConnackPacket).ReturnCode).To(BeEquivalentTo(packets.ErrRefusedNotAuthorised))
+
+					_, err := deviceClient.Read()
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+	})
 	Describe("ParseTopic", func() {
 		var prefix string
 		var path string
@@ -260,5 +528,19 @@ var _ = Describe("Device Message Handlers", func() {
 				Expect(filteredTopics[0].String()).To(Equal("matriarch/1.marsara/ota/state"))
 			})
 		})
+		Context("shared subscription", func() {
+			BeforeEach(func() {
+				sm = mqtt.SubscribeMessage{
+					Topics: []string{
+						"$share/ui/matriarch/1.marsara/ota/state",
+						"$share/ui/matriarch/+/ota/state",
+					},
+				}
+			})
+			It("matches the topic without the share prefix", func() {
+				Expect(len(filteredTopics)).To(Equal(1))
+				Expect(filteredTopics[0].String()).To(Equal("matriarch/1.marsara/ota/state"))
+			})
+		})
 	})
 })
@@ -0,0 +1,340 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bugsnagErrors "github.com/bugsnag/bugsnag-go/errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/mqtt"
+)
+
+const defaultTimeout = time.Second * 30
+
+const requestTopicPath = "rpc/"
+const replyTopicPath = "rpc/reply"
+
+// Errors reported to the caller in Response.Error. ErrDuplicateID is reported if the caller
+// sends a request with the ID of one of its own pending requests.
+const (
+	ErrDeviceOffline      = "device offline"
+	ErrDeviceDisconnected = "connection to device lost"
+	ErrTimeout            = "timeout"
+	ErrDuplicateID        = "duplicate request id"
+	ErrInvalidMethod      = "invalid method"
+	ErrInvalidRequest     = "invalid request"
+)
+
+type status string
+
+const (
+	// Success ...
+	Success status = "success"
+	// Error ...
+	Error status = "error"
+	// Timeout ...
+	Timeout status = "timeout"
+)
+
+// Request is published by control clients on armada/<device>/rpc/<method> and forwarded
+// to the device on pylon/<device>/rpc/<method>. The device gets an ID chosen by the handler,
+// so that the IDs of different callers do not collide.
+type Request struct {
+	ID     string          `json:"id"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Reply is published by devices on pylon/<device>/rpc/reply
+type Reply struct {
+	ID     string          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Response is published to the caller only: on the response topic of MQTT 5 requests,
+// otherwise on matriarch/<device>/rpc/reply/<client ID>. Responses to requests published
+// through the broker API go to matriarch/<device>/rpc/reply.
+type Response struct {
+	ID     string          `json:"id"`
+	Method string          `json:"method"`
+	Status status          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// callKey identifies a request by the client ID of the caller and the ID it chose
+type callKey struct {
+	caller string // empty for requests published through the broker API
+	id     string
+}
+
+type call struct {
+	method      string
+	forwardedID string // ID of the request sent to the device
+	reply       replyTo
+	timer       *time.Timer
+}
+
+// replyTo is where the response to a request is published
+type replyTo struct {
+	topic string
+	props *mqtt.Properties // correlation data of MQTT 5 requests
+}
+
+// Handler forwards requests of control clients to devices and their replies back to the caller.
+type Handler struct {
+	broker  *mqtt.Broker
+	timeout time.Duration
+
+	l       sync.Mutex
+	online  map[string]bool
+	pending map[string]map[callKey]*call // device name -> caller and request ID -> call
+	nextID  uint64
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
+	timeout := config.Config.RPCTimeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	h := &Handler{
+		broker:  broker,
+		timeout: timeout,
+		online:  make(map[string]bool),
+		pending: make(map[string]map[callKey]*call),
+	}
+
+	broker.Subscribe(devices.ConnectTopic.String(), h)
+	broker.Subscribe(devices.DisconnectTopic.String(), h)
+	broker.Subscribe("armada/+/"+requestTopicPath+"+", h)
+	broker.Subscribe("pylon/+/"+replyTopicPath, h)
+	return h
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(topic string, message interface{}) error {
+	return h.HandleMessageFrom(nil, topic, message, nil)
+}
+
+// HandleMessageFrom implements mqtt.SenderSubscriber
+func (h *Handler) HandleMessageFrom(session *mqtt.Session, topic string, message interface{}, props *mqtt.Properties) error {
+	t := devices.ParseTopic(topic)
+
+	switch {
+	case t.Path == devices.ConnectTopic.Path:
+		h.onConnect(message.(devices.ConnectMessage))
+		return nil
+	case t.Path == devices.DisconnectTopic.Path:
+		h.onDisconnect(message.(devices.DisconnectMessage))
+		return nil
+	}
+
+	buf, ok := message.([]byte)
+	if !ok {
+		return fmt.Errorf("[RPC] expected byte buffer, got this instead: %v", message)
+	}
+
+	switch {
+	case t.Prefix == "pylon" && t.Path == replyTopicPath:
+		return h.onReply(t.DeviceName, buf)
+	case t.Prefix == "armada" && strings.HasPrefix(t.Path, requestTopicPath):
+		return h.onRequest(session, props, t.DeviceName, strings.TrimPrefix(t.Path, requestTopicPath), buf)
+	}
+	return nil
+}
+
+func (h *Handler) onConnect(cm devices.ConnectMessage) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	h.online[cm.DeviceName] = true
+}
+
+// onDisconnect fails the pending requests of the device
+func (h *Handler) onDisconnect(dm devices.DisconnectMessage) {
+	h.l.Lock()
+	calls := h.pending[dm.DeviceName]
+	delete(h.pending, dm.DeviceName)
+	delete(h.online, dm.DeviceName)
+	h.l.Unlock()
+
+	for key, c := range calls {
+		c.timer.Stop()
+		h.respond(c.reply, Response{ID: key.id, Method: c.method, Status: Error, Error: ErrDeviceDisconnected})
+	}
+}
+
+// onRequest forwards the request to the device. Requests that cannot be parsed or have no id are
+// answered with ErrInvalidRequest and an empty id.
+func (h *Handler) onRequest(session *mqtt.Session, props *mqtt.Properties, deviceName, method string, buf []byte) error {
+	reply, err := h.replyTo(session, props, deviceName)
+	if err != nil {
+		return err
+	}
+
+	req := new(Request)
+	if err := json.Unmarshal(buf, req); err != nil {
+		h.respond(reply, Response{Method: method, Status: Error, Error: ErrInvalidRequest})
+		return bugsnagErrors.New(err, 1)
+	}
+
+	if len(req.ID) == 0 {
+		h.respond(reply, Response{Method: method, Status: Error, Error: ErrInvalidRequest})
+		return fmt.Errorf("[RPC] request for %s/%s without id", deviceName, method)
+	}
+
+	var caller string
+	if session != nil {
+		caller = session.ClientID()
+	}
+
+	forwardedID, errMsg := h.addCall(deviceName, method, callKey{caller, req.ID}, reply)
+	if len(errMsg) > 0 {
+		h.respond(reply, Response{ID: req.ID, Method: method, Status: Error, Error: errMsg})
+		return nil
+	}
+
+	topic := fmt.Sprintf("pylon/%s/%s%s", deviceName, requestTopicPath, method)
+	h.broker.Publish(topic, &Request{ID: forwardedID, Params: req.Params})
+	return nil
+}
+
+// replyTo returns where the response to a request of session is published. The response topic of MQTT 5
+// requests is used if the session may publish to it. Other clients need a client ID that is valid in a topic.
+func (h *Handler) replyTo(session *mqtt.Session, props *mqtt.Properties, deviceName string) (replyTo, error) {
+	topic := fmt.Sprintf("matriarch/%s/%s", deviceName, replyTopicPath)
+	if session == nil {
+		return replyTo{topic: topic}, nil
+	}
+
+	if props != nil && len(props.ResponseTopic) > 0 && validTopic(props.ResponseTopic) && h.broker.MayPublish(session, props.ResponseTopic) {
+		return replyTo{props.ResponseTopic, &mqtt.Properties{CorrelationData: props.CorrelationData}}, nil
+	}
+
+	clientID := session.ClientID()
+	if len(clientID) == 0 || !validTopic(clientID) {
+		return replyTo{}, fmt.Errorf("[RPC] cannot respond to request of client %q from %v", clientID, session.RemoteAddr())
+	}
+	return replyTo{topic: topic + "/" + clientID}, nil
+}
+
+// validTopic returns true if the broker delivers messages published to topic
+func validTopic(topic string) bool {
+	return !strings.ContainsAny(topic, "+#") && !strings.HasPrefix(topic, mqtt.InternalTopicPrefix+"/")
+}
+
+// addCall registers the request and starts its timeout. It returns the ID of the request to send to
+// the device, or the error to respond with if the request cannot be forwarded.
+func (h *Handler) addCall(deviceName, method string, key callKey, reply replyTo) (string, string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if method == "reply" {
+		return "", ErrInvalidMethod
+	}
+
+	if !h.online[deviceName] {
+		return "", ErrDeviceOffline
+	}
+
+	calls, exists := h.pending[deviceName]
+	if !exists {
+		calls = make(map[callKey]*call)
+		h.pending[deviceName] = calls
+	}
+
+	if _, exists := calls[key]; exists {
+		return "", ErrDuplicateID
+	}
+
+	h.nextID++
+	c := &call{method: method, forwardedID: strconv.FormatUint(h.nextID, 10), reply: reply}
+	c.timer = time.AfterFunc(h.timeout, func() {
+		if h.takeCall(deviceName, key, c) {
+			h.respond(reply, Response{ID: key.id, Method: method, Status: Timeout, Error: ErrTimeout})
+		}
+	})
+	calls[key] = c
+	return c.forwardedID, ""
+}
+
+// takeCall removes the pending request and returns true if it is still c
+func (h *Handler) takeCall(deviceName string, key callKey, c *call) bool {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if h.pending[deviceName][key] != c {
+		return false
+	}
+
+	delete(h.pending[deviceName], key)
+	if len(h.pending[deviceName]) == 0 {
+		delete(h.pending, deviceName)
+	}
+	return true
+}
+
+// findCall returns the pending request that was forwarded to the device with id
+func (h *Handler) findCall(deviceName, id string) (callKey, *call) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	for key, c := range h.pending[deviceName] {
+		if c.forwardedID == id {
+			return key, c
+		}
+	}
+	return callKey{}, nil
+}
+
+func (h *Handler) onReply(deviceName string, buf []byte) error {
+	reply := new(Reply)
+	if err := json.Unmarshal(buf, reply); err != nil {
+		return bugsnagErrors.New(err, 1)
+	}
+
+	key, c := h.findCall(deviceName, reply.ID)
+	if c == nil || !h.takeCall(deviceName, key, c) {
+		log.Printf("[RPC] ignoring reply from %s to unknown or expired request %q", deviceName, reply.ID)
+		return nil
+	}
+	c.timer.Stop()
+
+	resp := Response{ID: key.id, Method: c.method, Status: Success, Result: reply.Result}
+	if len(reply.Error) > 0 {
+		resp.Status = Error
+		resp.Error = reply.Error
+	}
+
+	h.respond(c.reply, resp)
+	return nil
+}
+
+// respond must not be called while holding h.l, because subscribers of the response run synchronously
+func (h *Handler) respond(to replyTo, resp Response) {
+	if to.props == nil {
+		h.broker.Publish(to.topic, resp)
+		return
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("[RPC] error while encoding response:", err)
+		return
+	}
+
+	pkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkg.TopicName = to.topic
+	pkg.Qos = mqtt.MaxQos
+	pkg.Payload = buf
+	h.broker.HandlePublishPacketWithProperties(pkg, to.props)
+}
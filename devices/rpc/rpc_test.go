@@ -0,0 +1,235 @@
+package rpc_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/rpc"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("RPC Message Handler", func() {
+
+	var broker *mqtt.Broker
+	var deviceRecorder, uiRecorder *testutils.PubSubRecorder
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var requestTopic = "armada/" + deviceName + "/rpc/reboot"
+	var deviceTopic = "pylon/" + deviceName + "/rpc/reboot"
+	var replyTopic = "pylon/" + deviceName + "/rpc/reply"
+	var uiTopic = "matriarch/" + deviceName + "/rpc/reply"
+
+	BeforeEach(func() {
+		config.Config.RPCTimeout = time.Millisecond * 100
+
+		broker = mqtt.NewBroker(false)
+		deviceRecorder = testutils.NewPubSubRecorder()
+		uiRecorder = testutils.NewPubSubRecorder()
+
+		broker.Subscribe(deviceTopic, deviceRecorder)
+		broker.Subscribe(uiTopic, uiRecorder)
+		rpc.Register(broker, devices.NewFormationMap())
+	})
+	AfterEach(func() {
+		config.Config.RPCTimeout = 0
+	})
+
+	response := func() rpc.Response {
+		_, raw := uiRecorder.Last()
+		return raw.(rpc.Response)
+	}
+
+	Context("device offline", func() {
+		It("responds with an error right away", func() {
+			broker.Publish(requestTopic, []byte(`{"id": "1"}`))
+
+			Expect(deviceRecorder.Count()).To(BeZero())
+			Expect(uiRecorder.Count()).To(Equal(1))
+			Expect(response()).To(Equal(rpc.Response{ID: "1", Method: "reboot", Status: rpc.Error, Error: rpc.ErrDeviceOffline}))
+		})
+	})
+	Context("invalid request", func() {
+		BeforeEach(func() {
+			broker.Publish(devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+		})
+		It("responds with an error to requests that are not JSON", func() {
+			broker.Publish(requestTopic, []byte(`{"id": `))
+
+			Expect(deviceRecorder.Count()).To(BeZero())
+			Expect(response()).To(Equal(rpc.Response{Method: "reboot", Status: rpc.Error, Error: rpc.ErrInvalidRequest}))
+		})
+		It("responds with an error to requests without id", func() {
+			broker.Publish(requestTopic, []byte(`{"params": {"delay": 5}}`))
+
+			Expect(deviceRecorder.Count()).To(BeZero())
+			Expect(response()).To(Equal(rpc.Response{Method: "reboot", Status: rpc.Error, Error: rpc.ErrInvalidRequest}))
+		})
+	})
+	Context("device online", func() {
+		BeforeEach(func() {
+			broker.Publish(devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+			broker.Publish(requestTopic, []byte(`{"id": "1", "params": {"delay": 5}}`))
+		})
+		It("forwards the request to the device", func() {
+			Expect(deviceRecorder.Count()).To(Equal(1))
+
+			_, raw := deviceRecorder.First()
+			buf, err := json.Marshal(raw)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf).To(MatchJSON(`{"id": "1", "params": {"delay": 5}}`))
+		})
+		It("publishes the result of the device", func() {
+			broker.Publish(replyTopic, []byte(`{"id": "1", "result": {"uptime": 0}}`))
+
+			Expect(uiRecorder.Count()).To(Equal(1))
+			resp := response()
+			Expect(resp.Status).To(Equal(rpc.Success))
+			Expect(resp.Method).To(Equal("reboot"))
+			Expect(resp.Result).To(MatchJSON(`{"uptime": 0}`))
+		})
+		It("publishes errors of the device", func() {
+			broker.Publish(replyTopic, []byte(`{"id": "1", "error": "permission denied"}`))
+
+			Expect(response()).To(Equal(rpc.Response{ID: "1", Method: "reboot", Status: rpc.Error, Error: "permission denied"}))
+		})
+		It("ignores replies to unknown requests", func() {
+			broker.Publish(replyTopic, []byte(`{"id": "2", "result": true}`))
+			Expect(uiRecorder.Count()).To(BeZero())
+		})
+		It("refuses duplicate request IDs", func() {
+			broker.Publish(requestTopic, []byte(`{"id": "1"}`))
+
+			Expect(deviceRecorder.Count()).To(Equal(1))
+			Expect(response().Error).To(Equal(rpc.ErrDuplicateID))
+		})
+		It("publishes a timeout if the device does not reply", func() {
+			Eventually(uiRecorder.Count).Should(Equal(1))
+			Expect(response()).To(Equal(rpc.Response{ID: "1", Method: "reboot", Status: rpc.Timeout, Error: rpc.ErrTimeout}))
+
+			broker.Publish(replyTopic, []byte(`{"id": "1", "result": true}`))
+			Consistently(uiRecorder.Count).Should(Equal(1))
+		})
+		It("fails pending requests when the device disconnects", func() {
+			broker.Publish(devices.DisconnectTopic.String(), devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName})
+
+			Expect(response().Error).To(Equal(rpc.ErrDeviceDisconnected))
+			Consistently(uiRecorder.Count, time.Millisecond*200).Should(Equal(1))
+		})
+	})
+	Context("requests of control clients", func() {
+		var clientRecorder *testutils.PubSubRecorder
+
+		// connect connects a control client and returns its end of the connection
+		connect := func(clientID string) *mqtt.Session {
+			brokerSession, client := testutils.Pipe()
+			go broker.HandleConnection(brokerSession)
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = clientID
+			Expect(client.Write(conPkg)).To(Succeed())
+
+			_, err := client.Read()
+			Expect(err).NotTo(HaveOccurred())
+			return client
+		}
+
+		request := func(client *mqtt.Session, payload string) {
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = requestTopic
+			pubPkg.Payload = []byte(payload)
+			Expect(client.Write(pubPkg)).To(Succeed())
+		}
+
+		// forwardedID returns the ID of the i-th request the device received
+		forwardedID := func(i int) string {
+			_, raw := deviceRecorder.Get(i)
+			return raw.(*rpc.Request).ID
+		}
+
+		BeforeEach(func() {
+			clientRecorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(uiTopic+"/+", clientRecorder)
+			broker.Publish(devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+		})
+		It("responds on the reply topic of the client", func() {
+			client := connect("matriarch-1")
+			defer client.Close()
+
+			request(client, `{"id": "1"}`)
+			Eventually(deviceRecorder.Count).Should(Equal(1))
+
+			broker.Publish(replyTopic, []byte(fmt.Sprintf(`{"id": "%s", "result": true}`, forwardedID(0))))
+
+			Expect(clientRecorder.Count()).To(Equal(1))
+			topic, raw := clientRecorder.First()
+			Expect(topic).To(Equal(uiTopic + "/matriarch-1"))
+			Expect(raw.(rpc.Response).ID).To(Equal("1"))
+			Expect(uiRecorder.Count()).To(BeZero())
+		})
+		It("keeps requests of clients with the same ID apart", func() {
+			first := connect("matriarch-1")
+			defer first.Close()
+			second := connect("matriarch-2")
+			defer second.Close()
+
+			request(first, `{"id": "1"}`)
+			Eventually(deviceRecorder.Count).Should(Equal(1))
+			request(second, `{"id": "1"}`)
+			Eventually(deviceRecorder.Count).Should(Equal(2))
+			Expect(forwardedID(0)).NotTo(Equal(forwardedID(1)))
+
+			broker.Publish(replyTopic, []byte(fmt.Sprintf(`{"id": "%s", "result": 2}`, forwardedID(1))))
+
+			Expect(clientRecorder.Count()).To(Equal(1))
+			topic, raw := clientRecorder.First()
+			Expect(topic).To(Equal(uiTopic + "/matriarch-2"))
+			Expect(raw.(rpc.Response)).To(Equal(rpc.Response{ID: "1", Method: "reboot", Status: rpc.Success, Result: json.RawMessage("2")}))
+		})
+		It("responds on the response topic of MQTT 5 requests with their correlation data", func() {
+			server, client := net.Pipe()
+			go broker.HandleConnection(mqtt.NewSession(server, time.Second))
+			defer client.Close()
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = "matriarch-5"
+			conPkg.CleanSession = true
+			Expect(mqtt.WritePacketV5(client, conPkg, nil)).To(Succeed())
+			_, _, err := mqtt.ReadPacketV5(client)
+			Expect(err).NotTo(HaveOccurred())
+
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.MessageID = 1
+			subPkg.Topics = []string{"matriarch/responses"}
+			subPkg.Qoss = []byte{0}
+			Expect(mqtt.WritePacketV5(client, subPkg, nil)).To(Succeed())
+			_, _, err = mqtt.ReadPacketV5(client)
+			Expect(err).NotTo(HaveOccurred())
+
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = requestTopic
+			pubPkg.Payload = []byte(`{"id": "1"}`)
+			props := &mqtt.Properties{ResponseTopic: "matriarch/responses", CorrelationData: []byte{4, 2}}
+			Expect(mqtt.WritePacketV5(client, pubPkg, props)).To(Succeed())
+			Eventually(deviceRecorder.Count).Should(Equal(1))
+
+			go broker.Publish(replyTopic, []byte(fmt.Sprintf(`{"id": "%s", "result": true}`, forwardedID(0))))
+
+			p, readProps, err := mqtt.ReadPacketV5(client)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).TopicName).To(Equal("matriarch/responses"))
+			Expect(p.(*packets.PublishPacket).Payload).To(MatchJSON(`{"id": "1", "method": "reboot", "status": "success", "result": true}`))
+			Expect(readProps.CorrelationData).To(Equal([]byte{4, 2}))
+			Expect(clientRecorder.Count()).To(BeZero())
+			Expect(uiRecorder.Count()).To(BeZero())
+		})
+	})
+})
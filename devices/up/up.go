@@ -90,20 +90,22 @@ func subscribeFilter(path string) bool {
 	return path == "up" || path == "#"
 }
 
+// onSubscribeEvent sends "down" for devices without a state. The state of the other devices
+// is retained, so the broker sends it on subscribe.
 func (h *Handler) onSubscribeEvent(sm mqtt.SubscribeMessage) error {
 
 	for _, t := range devices.FilterSubscribeTopics(sm, subscribeFilter) {
-		if msg, ok := h.formations.GetDeviceState(t.DeviceName, Key).(Message); ok {
-			h.sendToUI(t.DeviceName, msg)
-		} else {
-			h.sendToUI(t.DeviceName, Message{State: Down})
+		if _, ok := h.formations.GetDeviceState(t.DeviceName, Key).(Message); !ok {
+			topic := fmt.Sprintf("matriarch/%s/up", t.DeviceName)
+			h.broker.Publish(topic, Message{State: Down})
 		}
 	}
 
 	return nil
 }
 
+// sendToUI publishes the state as retained message, so that clients receive it when they subscribe
 func (h *Handler) sendToUI(deviceName string, msg Message) {
 	topic := fmt.Sprintf("matriarch/%s/up", deviceName)
-	h.broker.Publish(topic, msg)
+	h.broker.PublishRetained(topic, msg)
 }
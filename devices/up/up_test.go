@@ -111,59 +111,72 @@ var _ = Describe("Up Message Handler", func() {
 	})
 	Describe("sends current state on subscribe", func() {
 		var brokerSession, subscriberSession *mqtt.Session
-		var message up.Message
+		var received []*packets.PublishPacket
 
 		JustBeforeEach(func() {
 			brokerSession, subscriberSession = testutils.Pipe()
+			received = []*packets.PublishPacket{}
 
 			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
 			subPkg.Topics = []string{"matriarch/1.marsara/#"}
 			subPkg.MessageID = 1337
 
-			go broker.HandleSubscribePacket(subPkg, brokerSession, true)
+			go func() {
+				broker.HandleSubscribePacket(subPkg, brokerSession, true)
+				brokerSession.Close()
+			}()
 
 			// read suback packet
 			_, err := subscriberSession.Read()
 			Expect(err).NotTo(HaveOccurred())
 
-			p, err := subscriberSession.Read()
-			Expect(err).NotTo(HaveOccurred())
-
-			pubPkg, ok := p.(*packets.PublishPacket)
-			Expect(ok).To(BeTrue())
-
-			err = json.Unmarshal(pubPkg.Payload, &message)
-			Expect(err).NotTo(HaveOccurred())
+			for {
+				p, err := subscriberSession.Read()
+				if err != nil {
+					break
+				}
+				received = append(received, p.(*packets.PublishPacket))
+			}
 		})
 		AfterEach(func() {
-			brokerSession.Close()
 			subscriberSession.Close()
 		})
 		Context("with no device state in the cache", func() {
 			It("publishes an 'up' message for the device with state = \"down\"", func() {
+				Expect(received).To(HaveLen(1))
+				Expect(received[0].TopicName).To(Equal(upTopic))
+
+				var message up.Message
+				Expect(json.Unmarshal(received[0].Payload, &message)).To(Succeed())
 				Expect(message.State).To(Equal(up.Down))
 				Expect(message.Timestamp).To(Equal(int64(0)))
 			})
 		})
-		Context("with device state in the cache", func() {
-			var connectedSince int64
-
+		Context("with a connected device", func() {
 			BeforeEach(func() {
-				formations.Lock()
-				defer formations.Unlock()
-
-				connectedSince = time.Now().Add(-time.Minute * 5).UTC().Unix()
-
-				msg := up.Message{
-					State:     up.Up,
-					Timestamp: connectedSince,
-				}
-
-				formations.PutDeviceState(formationID, deviceName, up.Key, msg)
+				broker.Publish(devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
 			})
-			It("publishes an 'up' message for the device with state = \"up\"", func() {
+			It("publishes the retained 'up' message for the device with state = \"up\"", func() {
+				Expect(received).To(HaveLen(1))
+				Expect(received[0].TopicName).To(Equal(upTopic))
+				Expect(received[0].Retain).To(BeTrue())
+
+				var message up.Message
+				Expect(json.Unmarshal(received[0].Payload, &message)).To(Succeed())
 				Expect(message.State).To(Equal(up.Up))
-				Expect(message.Timestamp).To(Equal(connectedSince))
+				Expect(message.Timestamp).To(BeNumerically(">", 0))
+			})
+			Context("that disconnected", func() {
+				BeforeEach(func() {
+					broker.Publish(devices.DisconnectTopic.String(), devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName})
+				})
+				It("publishes the retained 'up' message for the device with state = \"down\"", func() {
+					Expect(received).To(HaveLen(1))
+
+					var message up.Message
+					Expect(json.Unmarshal(received[0].Payload, &message)).To(Succeed())
+					Expect(message.State).To(Equal(up.Down))
+				})
 			})
 		})
 	})
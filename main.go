@@ -1,21 +1,36 @@
 package main
 
 import (
+	"github.com/superscale/spire/auth"
+	"github.com/superscale/spire/bridge"
+	"github.com/superscale/spire/capture"
 	"github.com/superscale/spire/config"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/deviceInfo"
 	"github.com/superscale/spire/devices/exception"
 	"github.com/superscale/spire/devices/ota"
 	"github.com/superscale/spire/devices/ping"
+	"github.com/superscale/spire/devices/rpc"
 	"github.com/superscale/spire/devices/sentry"
 	"github.com/superscale/spire/devices/stations"
 	"github.com/superscale/spire/devices/up"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/monitoring"
+	"context"
+	"crypto/tls"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+
 	config.Parse()
 
 	if err := monitoring.InitMonitoring(config.Config.StatsdAddress); err != nil {
@@ -23,15 +38,200 @@ func main() {
 	}
 
 	broker := mqtt.NewBroker(config.Config.SlashPrefixTopics)
+	if authenticator := newAuthenticator(); authenticator != nil {
+		broker.SetAuthenticator(authenticator)
+	}
+
+	var captureWriter *capture.Writer
+	if len(config.Config.CaptureFile) > 0 {
+		var err error
+		if captureWriter, err = capture.NewWriter(config.Config.CaptureFile, config.Config.CaptureMaxSize, config.Config.CaptureMaxFiles); err != nil {
+			log.Fatal(err)
+		}
+		broker.SetRecorder(captureWriter)
+	}
+
+	statsPublisher := mqtt.NewStatsPublisher(broker, config.Config.StatsInterval)
+	go statsPublisher.Run()
+
+	var upstream *bridge.Bridge
+	if len(config.Config.BridgeAddress) > 0 {
+		upstream = newBridge(broker)
+		go upstream.Run()
+	}
+
 	formations := devices.NewFormationMap()
 	loadMessageHandlers(broker, formations)
 
 	devHandler := devices.NewHandler(formations, broker)
-	devicesServer := mqtt.NewServer(config.Config.DevicesBind, devHandler.HandleConnection)
-	go devicesServer.Run()
+	devHandler.SetRequireCertificate(len(config.Config.DevicesTLSClientCA) > 0)
+	devicesTLS := mqtt.TLSOptions{
+		CertFile:     config.Config.DevicesTLSCert,
+		KeyFile:      config.Config.DevicesTLSKey,
+		ClientCAFile: config.Config.DevicesTLSClientCA,
+	}
+	devicesLimits := mqtt.Limits{
+		AcceptRate:          config.Config.DevicesAcceptRate,
+		AcceptBurst:         config.Config.DevicesAcceptBurst,
+		MaxConnections:      config.Config.DevicesMaxConnections,
+		MaxConnectionsPerIP: config.Config.DevicesMaxConnectionsPerIP,
+		MaxHandshakes:       config.Config.DevicesMaxHandshakes,
+	}
+	devicesServer := newServer(config.Config.DevicesBind, devicesTLS, devHandler.HandleConnection)
+	devicesServer.SetLimits(devicesLimits)
+	devicesServer.SetProxyProtocol(config.Config.DevicesProxyProtocol)
+	go run(devicesServer)
+
+	controlTLS := mqtt.TLSOptions{
+		CertFile: config.Config.ControlTLSCert,
+		KeyFile:  config.Config.ControlTLSKey,
+	}
+	controlLimits := mqtt.Limits{
+		AcceptRate:          config.Config.ControlAcceptRate,
+		AcceptBurst:         config.Config.ControlAcceptBurst,
+		MaxConnections:      config.Config.ControlMaxConnections,
+		MaxConnectionsPerIP: config.Config.ControlMaxConnectionsPerIP,
+		MaxHandshakes:       config.Config.ControlMaxHandshakes,
+	}
+	controlServer := newServer(config.Config.ControlBind, controlTLS, broker.HandleConnection)
+	controlServer.SetLimits(controlLimits)
+	controlServer.SetProxyProtocol(config.Config.ControlProxyProtocol)
+	controlServers := []server{controlServer}
+
+	if len(config.Config.ControlWebSocketBind) > 0 {
+		wsServer := mqtt.NewWebSocketServer(config.Config.ControlWebSocketBind, newTLSConfig(controlTLS), broker.HandleConnection)
+		wsServer.SetLimits(controlLimits)
+		controlServers = append(controlServers, wsServer)
+	}
+
+	for _, s := range controlServers {
+		go run(s)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	log.Printf("received %v. shutting down", <-signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Config.ShutdownTimeout)
+	defer cancel()
+
+	// devices go first, so that control clients still receive their disconnect events
+	shutdown(ctx, devicesServer)
+	if upstream != nil {
+		upstream.Stop()
+	}
+	shutdown(ctx, controlServers...)
+	statsPublisher.Stop()
+
+	if captureWriter != nil {
+		if err := captureWriter.Close(); err != nil {
+			log.Println("error while closing capture:", err)
+		}
+	}
+}
+
+type server interface {
+	Run() error
+	Shutdown(ctx context.Context) error
+}
+
+func run(s server) {
+	if err := s.Run(); err != mqtt.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// shutdown shuts down the servers concurrently and waits for them
+func shutdown(ctx context.Context, servers ...server) {
+	var wg sync.WaitGroup
+
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s server) {
+			defer wg.Done()
+
+			if err := s.Shutdown(ctx); err != nil {
+				log.Println("error while shutting down:", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// newServer returns a TLS server if a certificate is configured for the listener
+func newServer(bind string, opts mqtt.TLSOptions, handler mqtt.SessionHandler) *mqtt.Server {
+	if tlsConfig := newTLSConfig(opts); tlsConfig != nil {
+		return mqtt.NewTLSServer(bind, tlsConfig, handler)
+	}
+	return mqtt.NewServer(bind, handler)
+}
+
+// newTLSConfig returns nil if TLS is not configured for the listener
+func newTLSConfig(opts mqtt.TLSOptions) *tls.Config {
+	if len(opts.CertFile) == 0 && len(opts.KeyFile) == 0 && len(opts.ClientCAFile) == 0 {
+		return nil
+	}
+
+	opts.MinVersion = config.Config.TLSMinVersion
+	opts.CipherSuites = config.Config.TLSCipherSuites
+	opts.ReloadInterval = config.Config.TLSReloadInterval
+
+	tlsConfig, err := mqtt.NewTLSConfig(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tlsConfig
+}
+
+// newAuthenticator returns nil if no authentication is configured for the control port
+func newAuthenticator() mqtt.Authenticator {
+	chain := auth.Chain{}
+
+	if len(config.Config.ControlUsersFile) > 0 {
+		static, err := auth.NewStatic(config.Config.ControlUsersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain = append(chain, static)
+	}
+
+	if len(config.Config.ControlJWTPublicKey) > 0 {
+		jwtAuth, err := auth.NewJWT(config.Config.ControlJWTPublicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain = append(chain, jwtAuth)
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain
+}
+
+func newBridge(broker *mqtt.Broker) *bridge.Bridge {
+	opts := bridge.Options{
+		Address:     config.Config.BridgeAddress,
+		ClientID:    config.Config.BridgeClientID,
+		Username:    config.Config.BridgeUsername,
+		Password:    config.Config.BridgePassword,
+		BufferSize:  config.Config.BridgeBufferSize,
+		MaxInflight: config.Config.BridgeMaxInflight,
+	}
+
+	if config.Config.BridgeTLS {
+		opts.TLS = &tls.Config{}
+	}
+
+	for _, topic := range config.Config.BridgeTopics {
+		m, err := bridge.ParseMapping(topic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Mappings = append(opts.Mappings, m)
+	}
 
-	controlServer := mqtt.NewServer(config.Config.ControlBind, broker.HandleConnection)
-	controlServer.Run()
+	return bridge.NewBridge(broker, opts)
 }
 
 type registerFn func(*mqtt.Broker, *devices.FormationMap) interface{}
@@ -43,6 +243,7 @@ func loadMessageHandlers(broker *mqtt.Broker, formations *devices.FormationMap)
 		exception.Register,
 		ota.Register,
 		ping.Register,
+		rpc.Register,
 		up.Register,
 		sentry.Register,
 		stations.Register,
@@ -14,15 +14,52 @@ const (
 	msgIngressID        = "messages.ingress"
 	msgEgressID         = "messages.egress"
 	deviceInfoRequestID = "requests.device_info"
+	offlineDroppedID    = "messages.offline_dropped"
+	droppedID           = "messages.dropped"
+	rejectedID          = "clients.rejected"
+	aclViolationID      = "acl.violations"
+	subscriptionsID     = "subscriptions"
+	handlerErrorID      = "handlers.errors"
 )
 
+// the counters are maintained even without a statsd client, for Snapshot
 var (
 	deviceClients  int64
 	controlClients int64
+	msgIngress     int64
+	msgEgress      int64
+	subscriptions  int64
+	handlerErrors  int64
+	startTime      = time.Now()
 	client         *statsd.Client
 	t              = make([]string, 0)
 )
 
+// Stats contains the current values of the counters maintained by this package
+type Stats struct {
+	DeviceClients  int64
+	ControlClients int64
+	MessagesIn     int64
+	MessagesOut    int64
+	Subscriptions  int64
+	HandlerErrors  int64
+	Uptime         time.Duration
+}
+
+// Snapshot returns the current values of the counters. MessagesIn, MessagesOut and HandlerErrors
+// are totals since the start of the process.
+func Snapshot() Stats {
+	return Stats{
+		DeviceClients:  atomic.LoadInt64(&deviceClients),
+		ControlClients: atomic.LoadInt64(&controlClients),
+		MessagesIn:     atomic.LoadInt64(&msgIngress),
+		MessagesOut:    atomic.LoadInt64(&msgEgress),
+		Subscriptions:  atomic.LoadInt64(&subscriptions),
+		HandlerErrors:  atomic.LoadInt64(&handlerErrors),
+		Uptime:         time.Since(startTime),
+	}
+}
+
 // InitMonitoring must be called before any of the other functions in this package, to enable data being sent to
 // the statsd instance listening on addr. It does nothing if addr is an empty string or when called a second time.
 func InitMonitoring(addr string) (err error) {
@@ -38,46 +75,47 @@ func InitMonitoring(addr string) (err error) {
 
 // AddDeviceClient increases the number of connected device clients
 func AddDeviceClient() {
+	n := atomic.AddInt64(&deviceClients, 1)
 	if client == nil {
 		return
 	}
 
-	atomic.AddInt64(&deviceClients, 1)
-	gauge(deviceClientsID, deviceClients)
+	gauge(deviceClientsID, n)
 }
 
 // RemoveDeviceClient decreases the number of connected device clients
 func RemoveDeviceClient() {
+	n := atomic.AddInt64(&deviceClients, -1)
 	if client == nil {
 		return
 	}
 
-	atomic.AddInt64(&deviceClients, -1)
-	gauge(deviceClientsID, deviceClients)
+	gauge(deviceClientsID, n)
 }
 
 // AddControlClient increases the number of connected control clients
 func AddControlClient() {
+	n := atomic.AddInt64(&controlClients, 1)
 	if client == nil {
 		return
 	}
 
-	atomic.AddInt64(&controlClients, 1)
-	gauge(controlClientsID, controlClients)
+	gauge(controlClientsID, n)
 }
 
 // RemoveControlClient decreases the number of connected control clients
 func RemoveControlClient() {
+	n := atomic.AddInt64(&controlClients, -1)
 	if client == nil {
 		return
 	}
 
-	atomic.AddInt64(&controlClients, -1)
-	gauge(controlClientsID, controlClients)
+	gauge(controlClientsID, n)
 }
 
 // CountMessageIngress increments the counter for messages received over the network
 func CountMessageIngress(topic string) {
+	atomic.AddInt64(&msgIngress, 1)
 	if client == nil {
 		return
 	}
@@ -87,6 +125,7 @@ func CountMessageIngress(topic string) {
 
 // CountMessageEgress increments the counter for messages sent over the network
 func CountMessageEgress(topic string) {
+	atomic.AddInt64(&msgEgress, 1)
 	if client == nil {
 		return
 	}
@@ -94,6 +133,85 @@ func CountMessageEgress(topic string) {
 	count(msgEgressID, topic)
 }
 
+// CountOfflineMessageDropped increments the counter for messages dropped because the queue of a
+// disconnected client was full
+func CountOfflineMessageDropped() {
+	if client == nil {
+		return
+	}
+
+	if err := client.Incr(offlineDroppedID, t, 1); err != nil {
+		log.Print(err)
+	}
+}
+
+// CountMessageDropped increments the counter for messages that could not be queued for a client
+// because its outbound queue was full
+func CountMessageDropped(policy string) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Count(droppedID, 1, []string{"policy:" + policy}, 1); err != nil {
+		log.Print(err)
+	}
+}
+
+// CountRejectedConnection increments the counter for connections that were refused for the given reason
+func CountRejectedConnection(reason string) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Count(rejectedID, 1, []string{"reason:" + reason}, 1); err != nil {
+		log.Print(err)
+	}
+}
+
+// CountACLViolation increments the counter for packets that were dropped because the client
+// was not allowed to publish or subscribe to the topic
+func CountACLViolation(action string) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Count(aclViolationID, 1, []string{"action:" + action}, 1); err != nil {
+		log.Print(err)
+	}
+}
+
+// AddSubscription increases the number of subscriptions held by the broker
+func AddSubscription() {
+	n := atomic.AddInt64(&subscriptions, 1)
+	if client == nil {
+		return
+	}
+
+	gauge(subscriptionsID, n)
+}
+
+// RemoveSubscription decreases the number of subscriptions held by the broker
+func RemoveSubscription() {
+	n := atomic.AddInt64(&subscriptions, -1)
+	if client == nil {
+		return
+	}
+
+	gauge(subscriptionsID, n)
+}
+
+// CountHandlerError increments the counter for messages a subscriber failed to handle
+func CountHandlerError() {
+	atomic.AddInt64(&handlerErrors, 1)
+	if client == nil {
+		return
+	}
+
+	if err := client.Incr(handlerErrorID, t, 1); err != nil {
+		log.Print(err)
+	}
+}
+
 // Segment records timing information for a segment of code
 type Segment struct {
 	startTime time.Time
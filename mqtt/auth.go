@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrBadCredentials is returned by an Authenticator if the user name or password is wrong
+var ErrBadCredentials = errors.New("bad user name or password")
+
+// ErrNotAuthorized is returned by an Authenticator if the credentials are valid but the client may not connect
+var ErrNotAuthorized = errors.New("not authorized")
+
+// Authenticator verifies the credentials sent in a CONNECT packet and returns the user they belong to
+type Authenticator interface {
+	Authenticate(pkg *packets.ConnectPacket) (*User, error)
+}
+
+// User is an authenticated client. Publish and Subscribe contain the topic filters
+// the user may publish to and subscribe to.
+type User struct {
+	Name      string   `json:"username"`
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// CanPublish returns true if topic matches one of the publish filters of the user.
+// A nil User may publish to any topic.
+func (u *User) CanPublish(topic string) bool {
+	return u == nil || anyFilterCovers(u.Publish, topic)
+}
+
+// CanSubscribe returns true if every topic matching filter also matches one of the
+// subscribe filters of the user. Shared subscriptions are checked without the share prefix.
+// A nil User may subscribe to any filter.
+func (u *User) CanSubscribe(filter string) bool {
+	return u == nil || anyFilterCovers(u.Subscribe, StripSharePrefix(filter))
+}
+
+func anyFilterCovers(acl []string, filter string) bool {
+	for _, a := range acl {
+		if filterCovers(a, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCovers returns true if all topics matched by filter are also matched by acl
+func filterCovers(acl, filter string) bool {
+	aclParts := strings.Split(strings.TrimPrefix(acl, "/"), "/")
+	filterParts := strings.Split(strings.TrimPrefix(filter, "/"), "/")
+
+	for i, a := range aclParts {
+		if a == "#" {
+			return true
+		}
+
+		if i >= len(filterParts) {
+			return false
+		}
+
+		f := filterParts[i]
+		if a == "+" {
+			if f == "#" {
+				return false
+			}
+			continue
+		}
+
+		if a != f {
+			return false
+		}
+	}
+
+	return len(aclParts) == len(filterParts)
+}
+
+// connackReturnCode maps an error returned by an Authenticator to a CONNACK return code
+func connackReturnCode(err error) byte {
+	if err == ErrNotAuthorized {
+		return packets.ErrRefusedNotAuthorised
+	}
+	return packets.ErrRefusedBadUsernameOrPassword
+}
@@ -0,0 +1,147 @@
+package mqtt_test
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+type fakeAuthenticator struct {
+	user *mqtt.User
+}
+
+func (a *fakeAuthenticator) Authenticate(pkg *packets.ConnectPacket) (*mqtt.User, error) {
+	if string(pkg.Password) != "hunter2" {
+		return nil, mqtt.ErrBadCredentials
+	}
+	return a.user, nil
+}
+
+var _ = Describe("Authentication", func() {
+
+	var brokerSession, clientSession *mqtt.Session
+	var broker *mqtt.Broker
+	var password string
+	var connack *packets.ConnackPacket
+
+	BeforeEach(func() {
+		brokerSession, clientSession = testutils.Pipe()
+		broker = mqtt.NewBroker(false)
+		broker.SetAuthenticator(&fakeAuthenticator{user: &mqtt.User{
+			Name:      "matriarch",
+			Publish:   []string{"armada/+/ota/#"},
+			Subscribe: []string{"pylon/#", "matriarch/+/up"},
+		}})
+		password = "hunter2"
+	})
+	JustBeforeEach(func() {
+		go broker.HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "matriarch-1"
+		conPkg.UsernameFlag = true
+		conPkg.Username = "matriarch"
+		conPkg.PasswordFlag = true
+		conPkg.Password = []byte(password)
+		Expect(clientSession.Write(conPkg)).NotTo(HaveOccurred())
+
+		p, err := clientSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+		connack = p.(*packets.ConnackPacket)
+	})
+	AfterEach(func() {
+		clientSession.Close()
+	})
+	It("accepts valid credentials", func() {
+		Expect(connack.ReturnCode).To(BeEquivalentTo(packets.Accepted))
+	})
+	Context("with a wrong password", func() {
+		BeforeEach(func() {
+			password = "hunter3"
+		})
+		It("refuses the connection", func() {
+			Expect(connack.ReturnCode).To(BeEquivalentTo(packets.ErrRefusedBadUsernameOrPassword))
+
+			_, err := clientSession.Read()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("publish", func() {
+		var recorder *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe("armada/#", recorder)
+		})
+		publish := func(topic string) {
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = topic
+			pubPkg.Qos = 1
+			pubPkg.MessageID = 1
+			pubPkg.Payload = []byte("{}")
+			Expect(clientSession.Write(pubPkg)).NotTo(HaveOccurred())
+
+			p, err := clientSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(BeAssignableToTypeOf(&packets.PubackPacket{}))
+		}
+		It("forwards messages to allowed topics", func() {
+			publish("armada/1.marsara/ota/sysupgrade")
+			Expect(recorder.Count()).To(Equal(1))
+		})
+		It("drops messages to other topics", func() {
+			publish("armada/1.marsara/reboot")
+			Consistently(recorder.Count, "20ms").Should(BeZero())
+		})
+	})
+	Describe("subscribe", func() {
+		It("refuses filters not covered by the ACL", func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{"pylon/+/up", "matriarch/#", "matriarch/1.marsara/up"}
+			subPkg.Qoss = []byte{0, 0, 0}
+			subPkg.MessageID = 1
+			Expect(clientSession.Write(subPkg)).NotTo(HaveOccurred())
+
+			p, err := clientSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.SubackPacket).ReturnCodes).To(Equal([]byte{0, mqtt.SubackFailure, 0}))
+
+			time.Sleep(time.Millisecond * 10)
+			broker.Publish("matriarch/1.marsara/wifi", []byte("{}"))
+			broker.Publish("matriarch/1.marsara/up", []byte("{}"))
+
+			p, err = clientSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).TopicName).To(Equal("matriarch/1.marsara/up"))
+		})
+	})
+})
+
+var _ = Describe("User", func() {
+	user := &mqtt.User{Subscribe: []string{"pylon/#", "matriarch/+/up", "armada/1.marsara"}}
+
+	It("allows filters covered by the subscribe ACL", func() {
+		Expect(user.CanSubscribe("pylon/1.marsara/wan/#")).To(BeTrue())
+		Expect(user.CanSubscribe("pylon")).To(BeTrue())
+		Expect(user.CanSubscribe("matriarch/+/up")).To(BeTrue())
+		Expect(user.CanSubscribe("matriarch/1.marsara/up")).To(BeTrue())
+		Expect(user.CanSubscribe("armada/1.marsara")).To(BeTrue())
+		Expect(user.CanSubscribe("$share/ui/matriarch/+/up")).To(BeTrue())
+	})
+	It("refuses filters that match topics outside of the subscribe ACL", func() {
+		Expect(user.CanSubscribe("matriarch/#")).To(BeFalse())
+		Expect(user.CanSubscribe("armada/+")).To(BeFalse())
+		Expect(user.CanSubscribe("armada/1.marsara/ota")).To(BeFalse())
+		Expect(user.CanSubscribe("foo/bar")).To(BeFalse())
+		Expect(user.CanSubscribe("$share/ui/matriarch/#")).To(BeFalse())
+	})
+	It("allows everything for a nil user", func() {
+		var nobody *mqtt.User
+		Expect(nobody.CanSubscribe("#")).To(BeTrue())
+		Expect(nobody.CanPublish("armada/1.marsara/ota")).To(BeTrue())
+	})
+})
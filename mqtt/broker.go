@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	bugsnag "github.com/bugsnag/bugsnag-go"
 	bugsnagErrors "github.com/bugsnag/bugsnag-go/errors"
@@ -23,7 +26,13 @@ type Subscriber interface {
 	HandleMessage(topic string, message interface{}) error
 }
 
-type subscriberMap map[string][]Subscriber
+// SenderSubscriber is a Subscriber that needs to know who published a message, for example to respond to it.
+// The broker calls HandleMessageFrom instead of HandleMessage. session is nil for messages published
+// through the broker API and props is nil unless the message was published with MQTT 5 properties.
+type SenderSubscriber interface {
+	Subscriber
+	HandleMessageFrom(session *Session, topic string, message interface{}, props *Properties) error
+}
 
 // SubscribeEventTopic is used by the broker to publish subscribe events on.
 const SubscribeEventTopic = InternalTopicPrefix + "/subscribe"
@@ -37,8 +46,21 @@ type SubscribeMessage struct {
 // Broker manages pub/sub
 type Broker struct {
 	l           sync.RWMutex
-	subscribers subscriberMap
+	subscribers *topicTrie
+	shared      map[string]*sharedGroup // shared subscription filter -> group
 	topicPrefix bool
+
+	// retained has its own lock, so that subscribers may publish retained messages from HandleMessage
+	retainedL sync.Mutex
+	retained  map[string]retainedMessage
+
+	live             map[string]*Session        // session key -> connected session
+	sessions         map[string]*offlineSession // session key -> state of disconnected persistent session
+	sessionExpiry    time.Duration
+	offlineQueueSize int
+
+	authenticator Authenticator
+	recorder      Recorder
 }
 
 // NewBroker ...
@@ -46,28 +68,71 @@ type Broker struct {
 // don't have one.
 func NewBroker(topicPrefix bool) *Broker {
 	return &Broker{
-		subscribers: make(subscriberMap),
+		subscribers: newTopicTrie(),
+		shared:      make(map[string]*sharedGroup),
+		retained:    make(map[string]retainedMessage),
 		topicPrefix: topicPrefix,
+		live:        make(map[string]*Session),
+		sessions:    make(map[string]*offlineSession),
+
+		sessionExpiry:    sessionExpiry(),
+		offlineQueueSize: offlineQueueSize(),
 	}
 }
 
+// SetAuthenticator makes HandleConnection verify the credentials of clients and
+// enforce the topic ACLs of the authenticated user. Without an authenticator all clients are accepted.
+func (b *Broker) SetAuthenticator(a Authenticator) {
+	b.authenticator = a
+}
+
 // HandleConnection ...
 func (b *Broker) HandleConnection(session *Session) {
-	if _, err := session.Handshake(); err != nil {
+	if len(session.Listener()) == 0 {
+		session.SetListener(ListenerControl)
+	}
+
+	connectPkg, err := session.ReadConnect()
+	if err != nil {
+		if err != io.EOF {
+			log.Println(err)
+		}
+		return
+	}
+
+	if err = b.authenticate(session, connectPkg); err != nil {
+		log.Printf("refusing connection from %v: %v", session.RemoteAddr(), err)
+		monitoring.CountRejectedConnection("auth")
+
+		session.RefuseConnect(connackReturnCode(err))
+		session.Close()
+		return
+	}
+	b.Takeover(session)
+
+	if err := session.AcknowledgeConnect(b.SessionPresent(session)); err != nil {
 		if err != io.EOF {
 			log.Println(err)
 		}
+		b.Remove(session)
+		session.Close()
 		return
 	}
 	monitoring.AddControlClient()
+	defer monitoring.RemoveControlClient()
+
+	if err := b.Resume(session); err != nil {
+		log.Printf("error while redelivering messages to peer %v: %v", session.RemoteAddr(), err)
+	}
 
 	for {
-		pkg, err := session.Read()
+		pkg, props, err := session.ReadWithProperties()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !session.TakenOver() {
 				log.Println(err)
 				session.Close()
 			}
+			b.PublishWill(session)
 			b.Remove(session)
 			return
 		}
@@ -76,15 +141,32 @@ func (b *Broker) HandleConnection(session *Session) {
 		case *packets.PingreqPacket:
 			err = session.SendPingresp()
 		case *packets.PublishPacket:
-			if !strings.HasPrefix(p.TopicName, InternalTopicPrefix+"/") {
-				b.Publish(p.TopicName, p.Payload)
+			if session.MarkReceived(p) && !strings.HasPrefix(p.TopicName, InternalTopicPrefix+"/") && b.MayPublish(session, p.TopicName) {
+				b.HandlePublishPacketFrom(session, p, props)
 			}
+			err = session.AcknowledgePublish(p)
+		case *packets.PubackPacket:
+			session.HandlePuback(p)
+		case *packets.PubrecPacket:
+			err = session.HandlePubrec(p)
+		case *packets.PubrelPacket:
+			err = session.HandlePubrel(p)
+		case *packets.PubcompPacket:
+			session.HandlePubcomp(p)
 		case *packets.SubscribePacket:
 			err = b.HandleSubscribePacket(p, session, true)
 		case *packets.UnsubscribePacket:
 			b.UnsubscribeAll(p, session)
-			err = session.SendUnsuback(p.MessageID)
+			err = session.AcknowledgeUnsubscribe(p)
+		case *packets.DisconnectPacket:
+			session.DiscardWill()
+			b.Remove(session)
+			if err = session.Close(); err != nil {
+				log.Println(err)
+			}
+			return
 		default:
+			b.PublishWill(session)
 			b.Remove(session)
 			if err = session.Close(); err != nil {
 				log.Println(err)
@@ -98,9 +180,37 @@ func (b *Broker) HandleConnection(session *Session) {
 	}
 }
 
+func (b *Broker) authenticate(session *Session, pkg *packets.ConnectPacket) error {
+	if b.authenticator == nil {
+		return nil
+	}
+
+	user, err := b.authenticator.Authenticate(pkg)
+	if err != nil {
+		return err
+	}
+
+	session.SetUser(user)
+	return nil
+}
+
+// MayPublish returns true if the user of the session may publish to topic. Violations are logged and counted.
+func (b *Broker) MayPublish(session *Session, topic string) bool {
+	user := session.User()
+	if user.CanPublish(topic) {
+		return true
+	}
+
+	log.Printf("user %s (%v) may not publish to %s", user.Name, session.RemoteAddr(), topic)
+	monitoring.CountACLViolation("publish")
+	return false
+}
+
 // Subscribe ...
+// Invalid topic filters are ignored.
 func (b *Broker) Subscribe(topic string, s Subscriber) {
-	if len(topic) == 0 {
+	if !ValidFilter(topic) {
+		log.Printf("ignoring subscription to invalid topic filter %q", topic)
 		return
 	}
 	topic = b.normalizeTopic(topic)
@@ -112,40 +222,119 @@ func (b *Broker) Subscribe(topic string, s Subscriber) {
 }
 
 func (b *Broker) subscribe(topic string, s Subscriber) {
-	subs, exists := b.subscribers[topic]
-	if !exists {
-		b.subscribers[topic] = []Subscriber{s}
+	if _, topicFilter, ok := ParseSharedFilter(topic); ok {
+		b.subscribeShared(topic, topicFilter, s)
 		return
 	}
+	b.subscribers.add(topic, s)
+}
+
+// HandlePublishPacket publishes the payload of the packet and stores it as retained message
+// if the packet has the retain flag set.
+func (b *Broker) HandlePublishPacket(pkg *packets.PublishPacket) {
+	b.HandlePublishPacketWithProperties(pkg, nil)
+}
+
+// HandlePublishPacketWithProperties is HandlePublishPacket for packets from MQTT 5 clients.
+// The payload format, message expiry, content type, response topic, correlation data and user properties
+// are forwarded to MQTT 5 subscribers. Subscribers using MQTT 3.1.1 receive the message without them.
+func (b *Broker) HandlePublishPacketWithProperties(pkg *packets.PublishPacket, props *Properties) {
+	b.HandlePublishPacketFrom(nil, pkg, props)
+}
+
+// HandlePublishPacketFrom is HandlePublishPacketWithProperties for packets received from session.
+// The message is recorded with the listener and client ID of the session.
+func (b *Broker) HandlePublishPacketFrom(session *Session, pkg *packets.PublishPacket, props *Properties) {
+	b.record(session, pkg.TopicName, pkg.Payload, pkg.Retain)
+	props = props.message(time.Now())
+
+	if pkg.Retain {
+		b.publishRetained(session, pkg.TopicName, pkg.Payload, pkg.Qos, props)
+	} else {
+		b.publish(session, pkg.TopicName, pkg.Payload, pkg.Qos, props)
+	}
+}
 
-	if indexOf(subs, s) != -1 {
+// PublishWill publishes the will message of a session that ended without DISCONNECT.
+// Will messages with internal topics are ignored.
+func (b *Broker) PublishWill(session *Session) {
+	will, props := session.takeWill()
+	if will == nil || strings.HasPrefix(will.TopicName, InternalTopicPrefix+"/") || !b.MayPublish(session, will.TopicName) {
 		return
 	}
 
-	b.subscribers[topic] = append(subs, s)
+	b.HandlePublishPacketFrom(session, will, props)
 }
 
 // HandleSubscribePacket subscribes the peer to all topics included in the packet
 // and publishes a SubscribeMessage under SubscribeEventTopic if sendSubscribeMessage is true.
+// The SUBACK contains the QoS granted for each topic, or SubackFailure for invalid filters
+// and topics the user of the session may not subscribe to. Retained messages matching any
+// of the subscribed topics are sent after the SUBACK, except for shared subscriptions.
+// The SubscribeMessage contains the topic filters without the share prefix.
 func (b *Broker) HandleSubscribePacket(pkg *packets.SubscribePacket, session *Session, sendSubscribeMessage bool) error {
+	user := session.User()
+	subscribed := []string{}
+	topicFilters := []string{}
+	retainedFilters := []string{}
+
 	b.l.Lock()
 
-	for _, topic := range pkg.Topics {
+	returnCodes := make([]byte, len(pkg.Topics))
+	for i, topic := range pkg.Topics {
+		if !ValidFilter(topic) {
+			log.Printf("invalid topic filter %q from %v", topic, session.RemoteAddr())
+
+			returnCodes[i] = SubackFailure
+			continue
+		}
+
+		if !user.CanSubscribe(topic) {
+			log.Printf("user %s (%v) may not subscribe to %s", user.Name, session.RemoteAddr(), topic)
+			monitoring.CountACLViolation("subscribe")
+
+			returnCodes[i] = SubackFailure
+			continue
+		}
+
+		var qos byte
+		if i < len(pkg.Qoss) {
+			qos = pkg.Qoss[i]
+		}
+
+		returnCodes[i] = session.Grant(topic, qos)
 		b.subscribe(topic, session)
+		subscribed = append(subscribed, topic)
+
+		if _, topicFilter, shared := ParseSharedFilter(topic); shared {
+			topicFilters = append(topicFilters, topicFilter)
+		} else {
+			topicFilters = append(topicFilters, topic)
+			retainedFilters = append(retainedFilters, topic)
+		}
 	}
-	if err := session.SendSuback(pkg.MessageID); err != nil {
-		for _, topic := range pkg.Topics {
+	if err := session.SendSuback(pkg.MessageID, returnCodes); err != nil {
+		for _, topic := range subscribed {
 			b.unsubscribe(topic, session)
+			session.Revoke(topic)
 		}
 		b.l.Unlock()
 		return err
 	}
+	// retained messages are queued before b.l is released, so that messages published
+	// in the meantime are sent after them
+	retained := b.matchRetained(retainedFilters)
+	for _, topic := range retained.topics {
+		m := retained.messages[topic]
+		if err := session.publish(topic, m.message, m.qos, true, m.props); err != nil {
+			b.l.Unlock()
+			return err
+		}
+	}
 	b.l.Unlock()
 
-	if sendSubscribeMessage {
-		subscribeMessage := SubscribeMessage{Topics: make([]string, len(pkg.Topics))}
-		copy(subscribeMessage.Topics, pkg.Topics)
-		b.Publish(SubscribeEventTopic, subscribeMessage)
+	if sendSubscribeMessage && len(topicFilters) > 0 {
+		b.Publish(SubscribeEventTopic, SubscribeMessage{Topics: topicFilters})
 	}
 	return nil
 }
@@ -164,26 +353,11 @@ func (b *Broker) Unsubscribe(topic string, s Subscriber) {
 }
 
 func (b *Broker) unsubscribe(topic string, s Subscriber) {
-	subs, exists := b.subscribers[topic]
-	if !exists {
+	if _, topicFilter, ok := ParseSharedFilter(topic); ok {
+		b.unsubscribeShared(topic, topicFilter, s)
 		return
 	}
-
-	i := indexOf(subs, s)
-	if i < 0 {
-		return
-	}
-
-	// from https://github.com/golang/go/wiki/SliceTricks
-	copy(subs[i:], subs[i+1:])
-	subs[len(subs)-1] = nil
-	subs = subs[:len(subs)-1]
-
-	if len(subs) == 0 {
-		delete(b.subscribers, topic)
-	} else {
-		b.subscribers[topic] = subs
-	}
+	b.subscribers.remove(topic, s)
 }
 
 // UnsubscribeAll ...
@@ -191,13 +365,28 @@ func (b *Broker) UnsubscribeAll(pkg *packets.UnsubscribePacket, s Subscriber) {
 	b.l.Lock()
 	defer b.l.Unlock()
 
+	sess, isSession := s.(*Session)
+
 	for _, topic := range pkg.Topics {
 		b.unsubscribe(topic, s)
+
+		if isSession {
+			sess.Revoke(topic)
+		}
 	}
 }
 
 // Publish ...
+// Sessions receive the message with the QoS they were granted on subscribe.
 func (b *Broker) Publish(topic string, message interface{}) {
+	b.record(nil, topic, message, false)
+	b.publish(nil, topic, message, MaxQos, nil)
+}
+
+// publish delivers the message to sessions with the lower one of qos and the QoS granted on subscribe.
+// props only reach sessions and SenderSubscribers, which also get the session the message came from;
+// other subscribers get the message alone.
+func (b *Broker) publish(from *Session, topic string, message interface{}, qos byte, props *Properties) {
 	if len(topic) == 0 {
 		return
 	}
@@ -206,19 +395,27 @@ func (b *Broker) Publish(topic string, message interface{}) {
 	b.l.RLock()
 	defer b.l.RUnlock()
 
-	topics := MatchTopics(topic, b.topics())
-	if len(topics) == 0 {
-		return
-	}
-
-	subs := []Subscriber{}
+	for _, s := range b.subscribers.match(topic) {
+		if g, ok := s.(*sharedGroup); ok {
+			if s = g.pick(); s == nil {
+				continue
+			}
+		}
 
-	for _, t := range topics {
-		subs = append(subs, b.get(t)...)
-	}
+		var err error
+		if sess, ok := s.(*Session); ok {
+			err = sess.publish(topic, message, qos, false, props)
+		} else if o, ok := s.(*offlineSession); ok {
+			o.enqueue(topic, message, qos, props)
+		} else if ss, ok := s.(SenderSubscriber); ok {
+			if err = ss.HandleMessageFrom(from, topic, message, props); err != nil {
+				monitoring.CountHandlerError()
+			}
+		} else if err = s.HandleMessage(topic, message); err != nil {
+			monitoring.CountHandlerError()
+		}
 
-	for _, s := range subs {
-		if err := s.HandleMessage(topic, message); err != nil {
+		if err != nil {
 			log.Println(err)
 
 			if _, ok := err.(*bugsnagErrors.Error); ok {
@@ -228,15 +425,222 @@ func (b *Broker) Publish(topic string, message interface{}) {
 	}
 }
 
+// PublishRetained publishes the message and stores it as the retained message for topic,
+// replacing the previous one. Clients receive it when they subscribe to a matching topic.
+// A nil message or an empty payload clears the retained message.
+func (b *Broker) PublishRetained(topic string, message interface{}) {
+	b.record(nil, topic, message, true)
+	b.publishRetained(nil, topic, message, MaxQos, nil)
+}
+
+func (b *Broker) publishRetained(from *Session, topic string, message interface{}, qos byte, props *Properties) {
+	if len(topic) == 0 {
+		return
+	}
+
+	b.retainedL.Lock()
+	if isEmpty(message) {
+		delete(b.retained, b.normalizeTopic(topic))
+	} else {
+		b.retained[b.normalizeTopic(topic)] = retainedMessage{message, qos, props}
+	}
+	b.retainedL.Unlock()
+
+	b.publish(from, topic, message, qos, props)
+}
+
+type retainedMessage struct {
+	message interface{}
+	qos     byte
+	props   *Properties
+}
+
+type retainedMessages struct {
+	topics   []string
+	messages map[string]retainedMessage
+}
+
+// matchRetained returns the retained messages with topics matching any of the filters,
+// sorted by topic. Expired messages are skipped.
+func (b *Broker) matchRetained(filters []string) retainedMessages {
+	res := retainedMessages{topics: []string{}, messages: make(map[string]retainedMessage)}
+	now := time.Now()
+
+	b.retainedL.Lock()
+	defer b.retainedL.Unlock()
+
+	for topic, message := range b.retained {
+		if message.props.expired(now) {
+			continue
+		}
+
+		topicParts := strings.Split(topic, "/")
+
+		for _, filter := range filters {
+			if len(filter) > 0 && TopicsMatch(topicParts, strings.Split(filter, "/")) {
+				res.topics = append(res.topics, topic)
+				res.messages[topic] = message
+				break
+			}
+		}
+	}
+
+	sort.Strings(res.topics)
+	return res
+}
+
 // Remove ...
+// Clients without the clean session flag keep their subscriptions and QoS 1 and QoS 2 message flows.
+// Messages published to them are queued until they reconnect or the session expires.
 func (b *Broker) Remove(s Subscriber) {
-	monitoring.RemoveControlClient()
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	sess, isSession := s.(*Session)
+	if isSession {
+		if sess.TakenOver() {
+			return
+		}
+
+		if b.live[sessionKey(sess)] == sess {
+			delete(b.live, sessionKey(sess))
+		}
+	}
+
+	b.remove(s)
+}
+
+// Takeover registers the session as the connected session for its client ID on its listener. A session
+// that is still connected with the same client ID on the same listener is closed and removed; it keeps
+// no will message and TakenOver() returns true for it. Sessions with an empty client ID are ignored.
+func (b *Broker) Takeover(session *Session) {
+	if len(session.ClientID()) == 0 {
+		return
+	}
 
 	b.l.Lock()
 	defer b.l.Unlock()
 
-	for topic := range b.subscribers {
-		b.unsubscribe(topic, s)
+	key := sessionKey(session)
+	old, exists := b.live[key]
+	b.live[key] = session
+
+	if exists && old != session {
+		log.Printf("client %s connected again from %v. closing previous connection from %v",
+			session.ClientID(), session.RemoteAddr(), old.RemoteAddr())
+
+		old.takeOver()
+		b.remove(old)
+	}
+}
+
+// remove unsubscribes s from all topics or, if it is a session that is kept after disconnect,
+// replaces it with an offlineSession. b.l must be held by the caller.
+func (b *Broker) remove(s Subscriber) {
+	if sess, ok := s.(*Session); ok && sess.isPersistent() {
+		b.persist(sess)
+		return
+	}
+
+	b.subscribers.removeAll(s)
+	b.leaveSharedGroups(s)
+}
+
+// SessionPresent returns true if the broker holds the state of a previous session with the same client ID
+// on the same listener. The state is discarded if the session has the clean session flag set.
+func (b *Broker) SessionPresent(session *Session) bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	o, exists := b.sessions[sessionKey(session)]
+	if !exists {
+		return false
+	}
+
+	if session.CleanSession() {
+		b.discard(o)
+		return false
+	}
+	return true
+}
+
+// Resume continues the previous session with the same client ID on the same listener, if there is one.
+// Subscriptions the user of the session may not subscribe to are dropped, together with their messages.
+// It must be called after CONNACK has been sent.
+func (b *Broker) Resume(session *Session) error {
+	b.l.Lock()
+
+	o, exists := b.sessions[sessionKey(session)]
+	if !exists || session.CleanSession() {
+		b.l.Unlock()
+		return nil
+	}
+
+	b.discard(o)
+
+	user := session.User()
+	for _, topic := range o.restrict(user) {
+		log.Printf("user %s (%v) may not subscribe to %s. dropping subscription of previous session", user.Name, session.RemoteAddr(), topic)
+		monitoring.CountACLViolation("subscribe")
+	}
+
+	for topic := range o.grantedQos {
+		b.subscribe(topic, session)
+	}
+	pending := session.restore(o)
+	b.l.Unlock()
+
+	return session.redeliver(pending, o.takeQueue())
+}
+
+// persist replaces the session with an offlineSession in all its subscriptions.
+// Shared subscriptions are left until the session resumes, so that messages go to connected members.
+// The offline session expires after the session expiry interval of MQTT 5 clients or else the one of the broker.
+// b.l must be held by the caller.
+func (b *Broker) persist(sess *Session) {
+	ids, grantedQos, queue := sess.detach()
+	o := newOfflineSession(sessionKey(sess), ids, grantedQos, b.offlineQueueSize)
+
+	for _, m := range queue {
+		o.enqueue(m.topic, m.message, m.qos, m.props)
+	}
+
+	b.subscribers.replace(sess, o)
+	b.leaveSharedGroups(sess)
+
+	if previous, exists := b.sessions[o.key]; exists {
+		b.discard(previous)
+	}
+
+	expiry := b.sessionExpiry
+	if sess.expiry > 0 {
+		expiry = sess.expiry
+	}
+
+	b.sessions[o.key] = o
+	o.expiry = time.AfterFunc(expiry, func() {
+		b.l.Lock()
+		defer b.l.Unlock()
+
+		if b.sessions[o.key] == o {
+			b.discard(o)
+		}
+	})
+}
+
+// sessionKey identifies the session of a client. Client IDs are only unique per listener,
+// so that control clients cannot take over the sessions of devices.
+func sessionKey(session *Session) string {
+	return session.Listener() + "/" + session.ClientID()
+}
+
+// discard removes the offline session and its subscriptions. b.l must be held by the caller.
+func (b *Broker) discard(o *offlineSession) {
+	o.expiry.Stop()
+	delete(b.sessions, o.key)
+
+	for topic := range o.grantedQos {
+		b.unsubscribe(topic, o)
 	}
 }
 
@@ -254,56 +658,84 @@ func MatchTopics(topic string, topics []string) []string {
 	return matches
 }
 
-func (b *Broker) topics() []string {
-	i := 0
-	res := make([]string, len(b.subscribers))
-	for topic := range b.subscribers {
-		res[i] = topic
-		i++
+const singleLevelWildcard = "+"
+const multiLevelWildcard = "#"
+
+// TopicsMatch returns true if the topic t1 matches the filter t2 as specified in MQTT
+// parameters are the topics split on "/"
+// returns false if t1 contains wildcards or t2 is not a valid filter (see ValidFilter)
+func TopicsMatch(t1, t2 []string) bool {
+	if !validTopicLevels(t1) || !validFilterLevels(t2) {
+		return false
 	}
 
-	return res
-}
+	for i, level := range t2 {
+		if level == multiLevelWildcard {
+			// also matches the parent level
+			return true
+		}
 
-func (b *Broker) get(topic string) []Subscriber {
-	subs, exists := b.subscribers[topic]
-	if !exists {
-		return []Subscriber{}
+		if i >= len(t1) {
+			return false
+		}
+
+		if level != singleLevelWildcard && level != t1[i] {
+			return false
+		}
 	}
-	return subs
+	return len(t1) == len(t2)
 }
 
-const singleLevelWildcard = "+"
-const multiLevelWildcard = "#"
+const maxTopicLength = 65535
 
-// TopicsMatch returns true if t1 matches t2 as specified in MQTT
-// parameters are the topics split on "/"
-// assumes that the topic in the first parameter does not contain wildcards
-// returns false for invalid topics (multi-level wildcards somewhere other than at the end)
-func TopicsMatch(t1, t2 []string) bool {
-	l1 := len(t1)
-	l2 := len(t2)
-
-	if l1 != l2 && t2[l2-1] != multiLevelWildcard {
+// ValidFilter returns true if filter is a valid topic filter for SUBSCRIBE. Wildcards must occupy
+// an entire level and "#" must be the last level. Empty levels are only allowed at the start,
+// because of topics prefixed with a slash.
+func ValidFilter(filter string) bool {
+	if len(filter) == 0 || len(filter) > maxTopicLength || !utf8.ValidString(filter) || strings.ContainsRune(filter, 0) {
 		return false
 	}
 
-	l := l1
-	if l2 < l1 {
-		l = l2
+	if strings.HasPrefix(filter, SharePrefix) {
+		_, topicFilter, ok := ParseSharedFilter(filter)
+		if !ok || len(topicFilter) == 0 {
+			return false
+		}
+		filter = topicFilter
 	}
+	return validFilterLevels(strings.Split(filter, "/"))
+}
 
-	for i := 0; i < l; i++ {
-		if t1[i] != t2[i] {
+func validFilterLevels(levels []string) bool {
+	if len(levels) == 0 {
+		return false
+	}
 
-			if t2[i] == singleLevelWildcard {
-				continue
+	for i, level := range levels {
+		switch {
+		case len(level) == 0:
+			if i > 0 || len(levels) == 1 {
+				return false
 			}
-
-			if t2[i] == multiLevelWildcard {
-				return i+1 == len(t2)
+		case level == multiLevelWildcard:
+			if i != len(levels)-1 {
+				return false
 			}
+		case level == singleLevelWildcard:
+		case strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard):
+			return false
+		}
+	}
+	return true
+}
+
+func validTopicLevels(levels []string) bool {
+	if len(levels) == 0 {
+		return false
+	}
 
+	for _, level := range levels {
+		if strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard) {
 			return false
 		}
 	}
@@ -311,12 +743,25 @@ func TopicsMatch(t1, t2 []string) bool {
 }
 
 func (b *Broker) normalizeTopic(topic string) string {
+	if group, topicFilter, ok := ParseSharedFilter(topic); ok {
+		return SharePrefix + group + "/" + b.normalizeTopic(topicFilter)
+	}
+
 	if b.topicPrefix && topic[0] != '/' {
 		return fmt.Sprintf("/%s", topic)
 	}
 	return topic
 }
 
+func isEmpty(message interface{}) bool {
+	if message == nil {
+		return true
+	}
+
+	buf, ok := message.([]byte)
+	return ok && len(buf) == 0
+}
+
 func indexOf(subscribers []Subscriber, s Subscriber) int {
 	for i, sub := range subscribers {
 		if sub == s {
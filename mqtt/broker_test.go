@@ -2,6 +2,8 @@ package mqtt_test
 
 import (
 	"encoding/json"
+	"fmt"
+	"testing"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
@@ -266,6 +268,101 @@ var _ = Describe("Broker", func() {
 				Expect(matches[1]).To(Equal("armada/+/sys/#"))
 			})
 		})
+		Context("with malformed filters", func() {
+			BeforeEach(func() {
+				publishTopic = "armada/1.marsara"
+
+				topics = []string{
+					"",
+					"armada/1.marsara/ota/#",
+					"armada/1.mar+",
+					"armada/#1.marsara",
+					"armada//1.marsara",
+				}
+			})
+			It("does not match", func() {
+				Expect(matches).To(BeEmpty())
+			})
+		})
+		It("does not match topics containing wildcards", func() {
+			Expect(mqtt.MatchTopics("armada/+", []string{"armada/+", "armada/#"})).To(BeEmpty())
+		})
+		It("does not panic on empty input", func() {
+			Expect(mqtt.TopicsMatch([]string{}, []string{})).To(BeFalse())
+			Expect(mqtt.TopicsMatch(nil, []string{"#"})).To(BeFalse())
+		})
+	})
+	Describe("ValidFilter", func() {
+		It("accepts wildcards occupying an entire level", func() {
+			Expect(mqtt.ValidFilter("#")).To(BeTrue())
+			Expect(mqtt.ValidFilter("+")).To(BeTrue())
+			Expect(mqtt.ValidFilter("pylon/+/wan/#")).To(BeTrue())
+			Expect(mqtt.ValidFilter("/pylon/1.marsara/up")).To(BeTrue())
+		})
+		It("refuses malformed filters", func() {
+			Expect(mqtt.ValidFilter("")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon/#/up")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon/1.marsara#")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon/+up")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon//up")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon/")).To(BeFalse())
+			Expect(mqtt.ValidFilter("/")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon/\x00")).To(BeFalse())
+			Expect(mqtt.ValidFilter("pylon/\xff")).To(BeFalse())
+		})
+	})
+	Context("subscribe with invalid filters", func() {
+		It("returns a failure code for each invalid filter", func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{"pylon/#/up", "pylon/+/up", "pylon//up", "armada/#"}
+			subPkg.Qoss = []byte{1, 1, 0, 2}
+			subPkg.MessageID = 1
+
+			go broker.HandleSubscribePacket(subPkg, brokerSession, false)
+
+			p, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.SubackPacket).ReturnCodes).To(Equal([]byte{mqtt.SubackFailure, 1, mqtt.SubackFailure, 2}))
+		})
+	})
+	Context("subscription matching", func() {
+		var recorder *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+		})
+		It("matches the parent level with a multi-level wildcard", func() {
+			broker.Subscribe("pylon/1.marsara/#", recorder)
+			broker.Publish("pylon/1.marsara", "hi")
+			Expect(recorder.Count()).To(Equal(1))
+		})
+		It("matches exactly one level with a single-level wildcard", func() {
+			broker.Subscribe("pylon/+/up", recorder)
+			broker.Publish("pylon/1.marsara/up", "hi")
+			broker.Publish("pylon/1.marsara/wan/up", "hi")
+			broker.Publish("pylon/up", "hi")
+			Expect(recorder.Count()).To(Equal(1))
+		})
+		It("does not match multi-level wildcards in the middle of a filter", func() {
+			broker.Subscribe("pylon/#/up", recorder)
+			broker.Publish("pylon/1.marsara/up", "hi")
+			Expect(recorder.Count()).To(BeZero())
+		})
+		It("delivers a message once to a subscriber with several matching filters", func() {
+			broker.Subscribe("pylon/#", recorder)
+			broker.Subscribe("pylon/+/up", recorder)
+			broker.Subscribe("pylon/1.marsara/up", recorder)
+			broker.Publish("pylon/1.marsara/up", "hi")
+			Expect(recorder.Count()).To(Equal(1))
+		})
+		It("keeps other filters with a common prefix after unsubscribe", func() {
+			broker.Subscribe("pylon/1.marsara/up", recorder)
+			broker.Subscribe("pylon/1.marsara/up/more", recorder)
+			broker.Unsubscribe("pylon/1.marsara/up/more", recorder)
+			broker.Publish("pylon/1.marsara/up", "hi")
+			broker.Publish("pylon/1.marsara/up/more", "hi")
+			Expect(recorder.Count()).To(Equal(1))
+		})
 	})
 	Context("multiple subscribers", func() {
 		var sub1, sub2 *testutils.PubSubRecorder
@@ -298,6 +395,213 @@ var _ = Describe("Broker", func() {
 			Expect(msg).To(Equal(payload))
 		})
 	})
+	Describe("retained messages", func() {
+		var filter string
+		var received []*packets.PublishPacket
+
+		BeforeEach(func() {
+			filter = "pylon/1.marsara/#"
+			received = []*packets.PublishPacket{}
+
+			broker.PublishRetained("pylon/1.marsara/up", map[string]string{"state": "up"})
+			broker.PublishRetained("pylon/1.marsara/wan/ping", []byte(`{"version": 1}`))
+			broker.PublishRetained("pylon/2.korhal/up", map[string]string{"state": "down"})
+		})
+		JustBeforeEach(func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{filter}
+			subPkg.MessageID = 1337
+
+			go func() {
+				broker.HandleSubscribePacket(subPkg, brokerSession, false)
+				brokerSession.Close()
+			}()
+
+			// read suback
+			_, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			for {
+				pkg, err := subscriberSession.Read()
+				if err != nil {
+					break
+				}
+				received = append(received, pkg.(*packets.PublishPacket))
+			}
+		})
+		It("sends retained messages matching a wildcard filter on subscribe", func() {
+			Expect(len(received)).To(Equal(2))
+
+			Expect(received[0].TopicName).To(Equal("pylon/1.marsara/up"))
+			Expect(received[0].Retain).To(BeTrue())
+			Expect(string(received[0].Payload)).To(Equal(`{"state":"up"}`))
+
+			Expect(received[1].TopicName).To(Equal("pylon/1.marsara/wan/ping"))
+			Expect(received[1].Retain).To(BeTrue())
+			Expect(string(received[1].Payload)).To(Equal(`{"version": 1}`))
+		})
+		Context("with a single-level wildcard", func() {
+			BeforeEach(func() {
+				filter = "pylon/+/up"
+			})
+			It("sends retained messages of all matching topics", func() {
+				Expect(len(received)).To(Equal(2))
+				Expect(received[0].TopicName).To(Equal("pylon/1.marsara/up"))
+				Expect(received[1].TopicName).To(Equal("pylon/2.korhal/up"))
+			})
+		})
+		Context("replaced by a newer message", func() {
+			BeforeEach(func() {
+				broker.PublishRetained("pylon/1.marsara/up", map[string]string{"state": "down"})
+			})
+			It("sends only the latest message", func() {
+				Expect(len(received)).To(Equal(2))
+				Expect(string(received[0].Payload)).To(Equal(`{"state":"down"}`))
+			})
+		})
+		Context("cleared with an empty payload", func() {
+			BeforeEach(func() {
+				broker.PublishRetained("pylon/1.marsara/wan/ping", []byte{})
+			})
+			It("does not send the cleared message", func() {
+				Expect(len(received)).To(Equal(1))
+				Expect(received[0].TopicName).To(Equal("pylon/1.marsara/up"))
+			})
+		})
+		Context("published by a subscriber while handling a message", func() {
+			BeforeEach(func() {
+				broker.Subscribe("pylon/1.marsara/ota", &retainingSubscriber{broker, "pylon/1.marsara/ota/state"})
+
+				done := make(chan struct{})
+				go func() {
+					broker.Publish("pylon/1.marsara/ota", []byte(`{"state": "default"}`))
+					close(done)
+				}()
+				Eventually(done).Should(BeClosed())
+			})
+			It("stores the message", func() {
+				Expect(len(received)).To(Equal(3))
+				Expect(received[0].TopicName).To(Equal("pylon/1.marsara/ota/state"))
+				Expect(string(received[0].Payload)).To(Equal(`{"state": "default"}`))
+			})
+		})
+		Context("published by a client with the retain flag", func() {
+			BeforeEach(func() {
+				pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				pubPkg.TopicName = "pylon/1.marsara/ota/state"
+				pubPkg.Retain = true
+				pubPkg.Payload = []byte(`{"state": "default"}`)
+				broker.HandlePublishPacket(pubPkg)
+			})
+			It("stores the message", func() {
+				Expect(len(received)).To(Equal(3))
+				Expect(received[0].TopicName).To(Equal("pylon/1.marsara/ota/state"))
+			})
+		})
+	})
+	Describe("last will and testament", func() {
+		var recorder *testutils.PubSubRecorder
+		var willTopic = "matriarch/control/status"
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(willTopic, recorder)
+
+			go broker.HandleConnection(brokerSession)
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = "control"
+			conPkg.WillFlag = true
+			conPkg.WillTopic = willTopic
+			conPkg.WillMessage = []byte("offline")
+			conPkg.WillQos = 1
+			conPkg.WillRetain = true
+			Expect(subscriberSession.Write(conPkg)).NotTo(HaveOccurred())
+
+			_, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+		})
+		Context("connection lost", func() {
+			BeforeEach(func() {
+				Expect(subscriberSession.Close()).NotTo(HaveOccurred())
+			})
+			It("publishes the will message", func() {
+				Eventually(func() int {
+					return recorder.Count()
+				}).Should(BeNumerically("==", 1))
+
+				topic, payload := recorder.First()
+				Expect(topic).To(Equal(willTopic))
+				Expect(payload).To(Equal([]byte("offline")))
+			})
+			It("retains the will message if the retain flag is set", func() {
+				Eventually(func() int {
+					return recorder.Count()
+				}).Should(BeNumerically("==", 1))
+
+				retainedSession, retainedSubscriber := testutils.Pipe()
+				defer retainedSession.Close()
+
+				subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+				subPkg.Topics = []string{willTopic}
+				subPkg.MessageID = 1337
+				go broker.HandleSubscribePacket(subPkg, retainedSession, false)
+
+				_, err := retainedSubscriber.Read()
+				Expect(err).NotTo(HaveOccurred())
+
+				pkg, err := retainedSubscriber.Read()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pkg.(*packets.PublishPacket).Payload).To(Equal([]byte("offline")))
+			})
+		})
+		Context("DISCONNECT", func() {
+			BeforeEach(func() {
+				Expect(subscriberSession.Write(packets.NewControlPacket(packets.Disconnect))).NotTo(HaveOccurred())
+			})
+			It("does not publish the will message", func() {
+				Consistently(func() int {
+					return recorder.Count()
+				}, "50ms").Should(BeZero())
+			})
+		})
+	})
+	Describe("session takeover", func() {
+		var newBrokerSession, newSubscriberSession *mqtt.Session
+
+		connect := func(server, client *mqtt.Session) {
+			go broker.HandleConnection(server)
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = "control"
+			Expect(client.Write(conPkg)).NotTo(HaveOccurred())
+
+			_, err := client.Read()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			newBrokerSession, newSubscriberSession = testutils.Pipe()
+
+			connect(brokerSession, subscriberSession)
+			connect(newBrokerSession, newSubscriberSession)
+		})
+		AfterEach(func() {
+			newSubscriberSession.Close()
+		})
+		It("closes the previous connection with the same client ID", func() {
+			_, err := subscriberSession.Read()
+			Expect(err).To(HaveOccurred())
+			Expect(brokerSession.TakenOver()).To(BeTrue())
+		})
+		It("keeps the new connection", func() {
+			Expect(newSubscriberSession.Write(packets.NewControlPacket(packets.Pingreq))).NotTo(HaveOccurred())
+
+			pkg, err := newSubscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pkg).To(BeAssignableToTypeOf(&packets.PingrespPacket{}))
+		})
+	})
 	Describe("internal topics", func() {
 		var sub *testutils.PubSubRecorder
 		var internalTopic = mqtt.InternalTopicPrefix + "/foo/bar"
@@ -333,3 +637,42 @@ var _ = Describe("Broker", func() {
 		})
 	})
 })
+
+type nopSubscriber struct{}
+
+func (nopSubscriber) HandleMessage(string, interface{}) error {
+	return nil
+}
+
+// retainingSubscriber stores every message it receives as retained message for topic
+type retainingSubscriber struct {
+	broker *mqtt.Broker
+	topic  string
+}
+
+func (r *retainingSubscriber) HandleMessage(topic string, message interface{}) error {
+	r.broker.PublishRetained(r.topic, message)
+	return nil
+}
+
+func benchmarkPublish(b *testing.B, subscriptions int) {
+	broker := mqtt.NewBroker(false)
+
+	for i := 0; i < subscriptions; i++ {
+		broker.Subscribe(fmt.Sprintf("pylon/%d.device/#", i), &nopSubscriber{})
+	}
+	broker.Subscribe("pylon/+/wan/ping", &nopSubscriber{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		broker.Publish(fmt.Sprintf("pylon/%d.device/wan/ping", i%subscriptions), nil)
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("%d subscriptions", n), func(b *testing.B) {
+			benchmarkPublish(b, n)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"context"
+	"log"
+
+	"github.com/superscale/spire/monitoring"
+)
+
+// Message is a message received from a channel returned by SubscribeChan.
+// Payload is a []byte for messages published by clients and the published value for internal publishers.
+type Message struct {
+	Topic   string
+	Payload interface{}
+}
+
+// chanSubscriber hands messages to a buffered channel without blocking the publisher
+type chanSubscriber struct {
+	ch chan Message
+}
+
+// HandleMessage implements Subscriber. The message is dropped if the channel is full.
+func (c *chanSubscriber) HandleMessage(topic string, message interface{}) error {
+	select {
+	case c.ch <- Message{Topic: topic, Payload: message}:
+	default:
+		monitoring.CountMessageDropped(string(DropNewest))
+	}
+	return nil
+}
+
+// SubscribeChan subscribes to filter and returns a channel receiving the matching messages.
+// Publishers never wait for the receiver: messages that do not fit into the buffer of bufSize are dropped.
+// The subscription ends and the channel is closed when ctx is done. For invalid filters the channel is closed right away.
+func (b *Broker) SubscribeChan(ctx context.Context, filter string, bufSize int) <-chan Message {
+	if bufSize < 0 {
+		bufSize = 0
+	}
+	c := &chanSubscriber{ch: make(chan Message, bufSize)}
+
+	if !ValidFilter(filter) {
+		log.Printf("ignoring subscription to invalid topic filter %q", filter)
+		close(c.ch)
+		return c.ch
+	}
+	b.Subscribe(filter, c)
+
+	go func() {
+		<-ctx.Done()
+
+		// the broker does not call HandleMessage once Unsubscribe has returned
+		b.Unsubscribe(filter, c)
+		close(c.ch)
+	}()
+	return c.ch
+}
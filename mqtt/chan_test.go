@@ -0,0 +1,58 @@
+package mqtt_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/mqtt"
+)
+
+var _ = Describe("SubscribeChan", func() {
+
+	var broker *mqtt.Broker
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false)
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+	AfterEach(func() {
+		cancel()
+	})
+	It("receives matching messages", func() {
+		messages := broker.SubscribeChan(ctx, "pylon/+/up", 10)
+
+		broker.Publish("pylon/1.marsara/up", map[string]bool{"up": true})
+		broker.Publish("pylon/1.marsara/down", []byte("ignored"))
+
+		var m mqtt.Message
+		Expect(messages).To(Receive(&m))
+		Expect(m.Topic).To(Equal("pylon/1.marsara/up"))
+		Expect(m.Payload).To(Equal(map[string]bool{"up": true}))
+		Expect(messages).NotTo(Receive())
+	})
+	It("drops messages instead of blocking the publisher when the buffer is full", func() {
+		messages := broker.SubscribeChan(ctx, "pylon/#", 2)
+
+		for i := 0; i < 5; i++ {
+			broker.Publish("pylon/1.marsara/up", i)
+		}
+
+		Expect(messages).To(HaveLen(2))
+		Expect((<-messages).Payload).To(Equal(0))
+		Expect((<-messages).Payload).To(Equal(1))
+	})
+	It("unsubscribes and closes the channel when the context is cancelled", func() {
+		messages := broker.SubscribeChan(ctx, "pylon/#", 10)
+		cancel()
+
+		Eventually(messages).Should(BeClosed())
+		broker.Publish("pylon/1.marsara/up", 1)
+	})
+	It("closes the channel right away for invalid filters", func() {
+		messages := broker.SubscribeChan(ctx, "pylon/#/up", 10)
+		Expect(messages).To(BeClosed())
+	})
+})
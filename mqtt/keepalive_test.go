@@ -0,0 +1,79 @@
+package mqtt_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+)
+
+var _ = Describe("Keep-alive", func() {
+
+	var brokerSession, clientSession *mqtt.Session
+	var keepAlive uint16
+	var connected time.Time
+
+	// elapsed returns the time from CONNACK until the broker closed the connection
+	elapsed := func() time.Duration {
+		for {
+			if _, err := clientSession.Read(); err != nil {
+				return time.Since(connected)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		config.Config.KeepAliveMin = time.Millisecond * 100
+		config.Config.KeepAliveMax = time.Millisecond * 300
+
+		a, b := net.Pipe()
+		brokerSession = mqtt.NewSession(a, time.Second*5)
+		clientSession = mqtt.NewSession(b, time.Second*5)
+	})
+	JustBeforeEach(func() {
+		go mqtt.NewBroker(false).HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.Keepalive = keepAlive
+		Expect(clientSession.Write(conPkg)).NotTo(HaveOccurred())
+
+		_, err := clientSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+		connected = time.Now()
+	})
+	AfterEach(func() {
+		clientSession.Close()
+
+		config.Config.KeepAliveMin = 0
+		config.Config.KeepAliveMax = 0
+	})
+	Context("longer than the maximum", func() {
+		BeforeEach(func() {
+			keepAlive = 60
+		})
+		It("closes the connection after the maximum", func() {
+			Expect(elapsed()).To(BeNumerically("~", time.Millisecond*300, time.Millisecond*150))
+		})
+	})
+	Context("disabled", func() {
+		BeforeEach(func() {
+			keepAlive = 0
+		})
+		It("closes the connection after the maximum", func() {
+			Expect(elapsed()).To(BeNumerically("~", time.Millisecond*300, time.Millisecond*150))
+		})
+	})
+	Context("within the limits", func() {
+		BeforeEach(func() {
+			keepAlive = 1
+			config.Config.KeepAliveMax = time.Second * 5
+		})
+		It("closes the connection after 1.5 times the keep-alive", func() {
+			Expect(elapsed()).To(BeNumerically("~", time.Millisecond*1500, time.Millisecond*250))
+		})
+	})
+})
@@ -0,0 +1,116 @@
+package mqtt
+
+import (
+	"log"
+	"math"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/superscale/spire/monitoring"
+)
+
+// refuseTimeout is the time refused connections have to send CONNECT. It is short, so that a flood of
+// refused connections does not hold on to goroutines and file descriptors.
+const refuseTimeout = time.Second
+
+// Limits restricts the connections a server accepts. Zero values mean no limit.
+// Connections exceeding a limit are refused with CONNACK "server unavailable".
+type Limits struct {
+	AcceptRate          float64 // new connections per second
+	AcceptBurst         int     // new connections accepted at once before AcceptRate applies. defaults to AcceptRate
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxHandshakes       int // connections that have not been acknowledged or refused by the session handler yet
+}
+
+// rateLimiter is a token bucket. It is not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+
+	r.tokens--
+	return true
+}
+
+// setLimits must be called before the server accepts connections
+func (g *sessionGroup) setLimits(limits Limits) {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	g.limits = limits
+	g.limiter = nil
+	if limits.AcceptRate > 0 {
+		g.limiter = newRateLimiter(limits.AcceptRate, limits.AcceptBurst)
+	}
+}
+
+// admit returns the reason for refusing a connection from ip or an empty string
+// if it is within the limits. g.l must be held by the caller.
+func (g *sessionGroup) admit(ip string) string {
+	switch {
+	case g.limiter != nil && !g.limiter.allow(time.Now()):
+		return "rate_limit"
+	case g.limits.MaxConnections > 0 && len(g.sessions) >= g.limits.MaxConnections:
+		return "max_connections"
+	case g.limits.MaxConnectionsPerIP > 0 && g.perIP[ip] >= g.limits.MaxConnectionsPerIP:
+		return "max_connections_per_ip"
+	case g.limits.MaxHandshakes > 0 && g.handshakes >= g.limits.MaxHandshakes:
+		return "max_handshakes"
+	}
+	return ""
+}
+
+// endHandshake is called once per admitted session, when it has been acknowledged or refused or has ended
+func (g *sessionGroup) endHandshake() {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	g.handshakes--
+}
+
+// refuse reads the CONNECT packet and responds with CONNACK "server unavailable"
+func refuse(conn net.Conn, reason string) {
+	log.Printf("refusing connection from %v: %s", conn.RemoteAddr(), reason)
+	monitoring.CountRejectedConnection(reason)
+
+	session := NewSession(conn, refuseTimeout)
+	if _, err := session.ReadConnect(); err == nil {
+		session.RefuseConnect(packets.ErrRefusedServerUnavailable)
+	}
+	session.Close()
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
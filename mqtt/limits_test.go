@@ -0,0 +1,130 @@
+package mqtt_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+)
+
+var _ = Describe("Connection limits", func() {
+
+	var server *mqtt.Server
+	var limits mqtt.Limits
+	var clients []*mqtt.Session
+
+	dial := func() *mqtt.Session {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		client := mqtt.NewSession(conn, time.Second)
+		clients = append(clients, client)
+		return client
+	}
+
+	connect := func(client *mqtt.Session, clientID string) byte {
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = clientID
+		conPkg.Keepalive = 30
+		Expect(client.Write(conPkg)).NotTo(HaveOccurred())
+
+		p, err := client.Read()
+		Expect(err).NotTo(HaveOccurred())
+		return p.(*packets.ConnackPacket).ReturnCode
+	}
+
+	BeforeEach(func() {
+		limits = mqtt.Limits{}
+		clients = nil
+	})
+	JustBeforeEach(func() {
+		server = mqtt.NewServer("127.0.0.1:0", mqtt.NewBroker(false).HandleConnection)
+		server.SetLimits(limits)
+		go server.Run()
+		Eventually(server.Addr).ShouldNot(BeNil())
+	})
+	AfterEach(func() {
+		for _, c := range clients {
+			c.Close()
+		}
+		Expect(server.Shutdown(context.Background())).To(Succeed())
+		config.Config.IdleConnectionTimeout = time.Second
+	})
+	Context("max connections", func() {
+		BeforeEach(func() {
+			limits.MaxConnections = 1
+		})
+		It("refuses connections beyond the limit with server unavailable", func() {
+			Expect(connect(dial(), "matriarch-1")).To(BeEquivalentTo(packets.Accepted))
+			Expect(connect(dial(), "matriarch-2")).To(BeEquivalentTo(packets.ErrRefusedServerUnavailable))
+		})
+		Context("with a long idle connection timeout", func() {
+			BeforeEach(func() {
+				config.Config.IdleConnectionTimeout = time.Minute
+			})
+			It("closes refused connections that do not send CONNECT within a second", func() {
+				Expect(connect(dial(), "matriarch-1")).To(BeEquivalentTo(packets.Accepted))
+
+				conn, err := net.Dial("tcp", server.Addr().String())
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+
+				Expect(conn.SetReadDeadline(time.Now().Add(time.Second * 3))).To(Succeed())
+				_, err = conn.Read(make([]byte, 1))
+				Expect(err).To(Equal(io.EOF))
+			})
+		})
+		It("accepts connections again once clients disconnected", func() {
+			first := dial()
+			Expect(connect(first, "matriarch-1")).To(BeEquivalentTo(packets.Accepted))
+			Expect(first.Write(packets.NewControlPacket(packets.Disconnect))).To(Succeed())
+
+			Eventually(func() byte {
+				return connect(dial(), "matriarch-2")
+			}).Should(BeEquivalentTo(packets.Accepted))
+		})
+	})
+	Context("max connections per IP", func() {
+		BeforeEach(func() {
+			limits.MaxConnectionsPerIP = 2
+		})
+		It("refuses connections beyond the limit from the same address", func() {
+			Expect(connect(dial(), "matriarch-1")).To(BeEquivalentTo(packets.Accepted))
+			Expect(connect(dial(), "matriarch-2")).To(BeEquivalentTo(packets.Accepted))
+			Expect(connect(dial(), "matriarch-3")).To(BeEquivalentTo(packets.ErrRefusedServerUnavailable))
+		})
+	})
+	Context("max handshakes", func() {
+		BeforeEach(func() {
+			limits.MaxHandshakes = 1
+		})
+		It("refuses connections while another one has not been acknowledged", func() {
+			pending := dial()
+			time.Sleep(time.Millisecond * 10)
+
+			Expect(connect(dial(), "matriarch-2")).To(BeEquivalentTo(packets.ErrRefusedServerUnavailable))
+
+			Expect(connect(pending, "matriarch-1")).To(BeEquivalentTo(packets.Accepted))
+			Expect(connect(dial(), "matriarch-3")).To(BeEquivalentTo(packets.Accepted))
+		})
+	})
+	Context("accept rate", func() {
+		BeforeEach(func() {
+			limits.AcceptRate = 10
+			limits.AcceptBurst = 1
+		})
+		It("refuses connections arriving faster than the rate", func() {
+			Expect(connect(dial(), "matriarch-1")).To(BeEquivalentTo(packets.Accepted))
+			Expect(connect(dial(), "matriarch-2")).To(BeEquivalentTo(packets.ErrRefusedServerUnavailable))
+
+			time.Sleep(time.Millisecond * 100)
+			Expect(connect(dial(), "matriarch-3")).To(BeEquivalentTo(packets.Accepted))
+		})
+	})
+})
@@ -2,6 +2,7 @@ package mqtt_test
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -10,6 +11,7 @@ import (
 
 var _ = BeforeSuite(func() {
 	config.Config.Environment = "test"
+	config.Config.IdleConnectionTimeout = time.Second
 })
 
 // TestHandlers ...
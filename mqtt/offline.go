@@ -0,0 +1,126 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/monitoring"
+)
+
+const defaultOfflineQueueSize = 1000
+const defaultSessionExpiry = time.Hour
+
+// offlineSession stands in for a disconnected client that did not set the clean session flag.
+// It keeps the subscriptions and QoS 1 and QoS 2 message flows of the client and queues
+// messages published while the client is away.
+type offlineSession struct {
+	key        string // listener and client ID, see sessionKey
+	ids        *packetIDState
+	grantedQos map[string]byte
+	expiry     *time.Timer
+
+	l         sync.Mutex
+	queue     []queuedMessage
+	queueSize int
+}
+
+type queuedMessage struct {
+	topic   string
+	message interface{}
+	qos     byte
+	retain  bool
+	props   *Properties
+}
+
+func newOfflineSession(key string, ids *packetIDState, grantedQos map[string]byte, queueSize int) *offlineSession {
+	return &offlineSession{
+		key:        key,
+		ids:        ids,
+		grantedQos: grantedQos,
+		queue:      []queuedMessage{},
+		queueSize:  queueSize,
+	}
+}
+
+// HandleMessage implements Subscriber
+func (o *offlineSession) HandleMessage(topic string, message interface{}) error {
+	o.enqueue(topic, message, MaxQos, nil)
+	return nil
+}
+
+// enqueue stores messages with QoS 1 or QoS 2 until the client reconnects.
+// When the queue is full the oldest message is dropped. Expired messages are dropped when the client reconnects.
+func (o *offlineSession) enqueue(topic string, message interface{}, qos byte, props *Properties) {
+	if granted := matchQos(o.grantedQos, topic); granted < qos {
+		qos = granted
+	}
+	if qos == 0 {
+		return
+	}
+
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if len(o.queue) >= o.queueSize {
+		o.queue = o.queue[1:]
+		monitoring.CountOfflineMessageDropped()
+	}
+	o.queue = append(o.queue, queuedMessage{topic: topic, message: message, qos: qos, props: props})
+}
+
+func (o *offlineSession) takeQueue() []queuedMessage {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	queue := o.queue
+	o.queue = []queuedMessage{}
+	return queue
+}
+
+// restrict removes the subscriptions user may not subscribe to and drops the queued and unacknowledged
+// messages that no remaining subscription matches. It returns the removed topic filters.
+func (o *offlineSession) restrict(user *User) []string {
+	revoked := []string{}
+	for filter := range o.grantedQos {
+		if !user.CanSubscribe(filter) {
+			delete(o.grantedQos, filter)
+			revoked = append(revoked, filter)
+		}
+	}
+	if len(revoked) == 0 {
+		return revoked
+	}
+
+	for id, m := range o.ids.outbound {
+		if !m.released && matchQos(o.grantedQos, m.pkg.TopicName) == 0 {
+			delete(o.ids.outbound, id)
+		}
+	}
+
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	queue := []queuedMessage{}
+	for _, m := range o.queue {
+		if matchQos(o.grantedQos, m.topic) > 0 {
+			queue = append(queue, m)
+		}
+	}
+	o.queue = queue
+	return revoked
+}
+
+func offlineQueueSize() int {
+	if config.Config.OfflineQueueSize <= 0 {
+		return defaultOfflineQueueSize
+	}
+	return config.Config.OfflineQueueSize
+}
+
+func sessionExpiry() time.Duration {
+	if config.Config.SessionExpiry <= 0 {
+		return defaultSessionExpiry
+	}
+	return config.Config.SessionExpiry
+}
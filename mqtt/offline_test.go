@@ -0,0 +1,245 @@
+package mqtt_test
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Persistent sessions", func() {
+
+	var brokerSession, clientSession *mqtt.Session
+	var broker *mqtt.Broker
+	var authenticator *fakeAuthenticator
+	var topic = "pylon/1.marsara/ota/sysupgrade"
+
+	connect := func(cleanSession bool) *packets.ConnackPacket {
+		brokerSession, clientSession = testutils.Pipe()
+		go broker.HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "control"
+		conPkg.CleanSession = cleanSession
+		conPkg.UsernameFlag = true
+		conPkg.Username = "matriarch"
+		conPkg.PasswordFlag = true
+		conPkg.Password = []byte("hunter2")
+		Expect(clientSession.Write(conPkg)).NotTo(HaveOccurred())
+
+		p, err := clientSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+		return p.(*packets.ConnackPacket)
+	}
+
+	disconnect := func() {
+		// wait for the broker to remove the session
+		Expect(clientSession.Close()).NotTo(HaveOccurred())
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// readAll acknowledges and returns the PUBLISH packets the client receives until the broker closes the connection
+	readAll := func() []*packets.PublishPacket {
+		go func() {
+			time.Sleep(time.Millisecond * 50)
+			brokerSession.Close()
+		}()
+
+		res := []*packets.PublishPacket{}
+		for {
+			p, err := clientSession.Read()
+			if err != nil {
+				return res
+			}
+
+			pubPkg := p.(*packets.PublishPacket)
+			res = append(res, pubPkg)
+			go clientSession.SendPuback(pubPkg.MessageID)
+		}
+	}
+
+	BeforeEach(func() {
+		config.Config.RetryInterval = time.Hour
+	})
+	JustBeforeEach(func() {
+		broker = mqtt.NewBroker(false)
+		authenticator = &fakeAuthenticator{}
+		broker.SetAuthenticator(authenticator)
+
+		connect(false)
+
+		subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subPkg.Topics = []string{"pylon/1.marsara/#"}
+		subPkg.Qoss = []byte{1}
+		subPkg.MessageID = 1337
+		Expect(clientSession.Write(subPkg)).NotTo(HaveOccurred())
+
+		_, err := clientSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		disconnect()
+	})
+	AfterEach(func() {
+		config.Config.RetryInterval = 0
+		config.Config.OfflineQueueSize = 0
+		config.Config.SessionExpiry = 0
+		brokerSession.Close()
+		clientSession.Close()
+	})
+	Describe("reconnect without clean session", func() {
+		JustBeforeEach(func() {
+			broker.Publish(topic, []byte("1"))
+			broker.Publish(topic, []byte("2"))
+		})
+		It("sets session present in CONNACK", func() {
+			Expect(connect(false).SessionPresent).To(BeTrue())
+		})
+		It("delivers messages published while the client was offline", func() {
+			connect(false)
+			received := readAll()
+
+			Expect(len(received)).To(Equal(2))
+			Expect(received[0].Payload).To(Equal([]byte("1")))
+			Expect(received[0].Qos).To(Equal(byte(1)))
+			Expect(received[1].Payload).To(Equal([]byte("2")))
+		})
+		It("keeps the subscriptions", func() {
+			connect(false)
+			readAll()
+
+			connect(false)
+			go broker.Publish(topic, []byte("3"))
+
+			p, err := clientSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).Payload).To(Equal([]byte("3")))
+		})
+	})
+	Describe("reconnect that fails before CONNACK", func() {
+		JustBeforeEach(func() {
+			broker.Publish(topic, []byte("1"))
+
+			brokerSession, clientSession = testutils.Pipe()
+			go broker.HandleConnection(brokerSession)
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = "control"
+			conPkg.PasswordFlag = true
+			conPkg.Password = []byte("hunter2")
+			Expect(clientSession.Write(conPkg)).NotTo(HaveOccurred())
+			disconnect()
+		})
+		It("keeps the previous session", func() {
+			Expect(connect(false).SessionPresent).To(BeTrue())
+
+			received := readAll()
+			Expect(len(received)).To(Equal(1))
+			Expect(received[0].Payload).To(Equal([]byte("1")))
+		})
+	})
+	Describe("reconnect after messages with QoS 0", func() {
+		JustBeforeEach(func() {
+			publisherSession, publisher := testutils.Pipe()
+			go broker.HandleConnection(publisherSession)
+			defer publisher.Close()
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = "publisher"
+			conPkg.PasswordFlag = true
+			conPkg.Password = []byte("hunter2")
+			Expect(publisher.Write(conPkg)).NotTo(HaveOccurred())
+			_, err := publisher.Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = topic
+			pubPkg.Payload = []byte("0")
+			Expect(publisher.Write(pubPkg)).NotTo(HaveOccurred())
+			time.Sleep(time.Millisecond * 10)
+
+			broker.Publish(topic, []byte("1"))
+		})
+		It("does not queue them", func() {
+			connect(false)
+			received := readAll()
+
+			Expect(len(received)).To(Equal(1))
+			Expect(received[0].Payload).To(Equal([]byte("1")))
+		})
+	})
+	Describe("reconnect with fewer permissions", func() {
+		JustBeforeEach(func() {
+			broker.Publish(topic, []byte("1"))
+			authenticator.user = &mqtt.User{Name: "matriarch", Subscribe: []string{"matriarch/#"}}
+		})
+		It("drops the subscriptions the user may no longer subscribe to and their messages", func() {
+			Expect(connect(false).SessionPresent).To(BeTrue())
+			Expect(readAll()).To(BeEmpty())
+
+			connect(false)
+			go broker.Publish(topic, []byte("2"))
+			Expect(readAll()).To(BeEmpty())
+		})
+	})
+	Describe("reconnect on another listener", func() {
+		It("does not resume the session", func() {
+			brokerSession, clientSession = testutils.Pipe()
+			brokerSession.SetListener(mqtt.ListenerDevices)
+			go broker.HandleConnection(brokerSession)
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = "control"
+			conPkg.UsernameFlag = true
+			conPkg.Username = "matriarch"
+			conPkg.PasswordFlag = true
+			conPkg.Password = []byte("hunter2")
+			Expect(clientSession.Write(conPkg)).NotTo(HaveOccurred())
+
+			p, err := clientSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.ConnackPacket).SessionPresent).To(BeFalse())
+		})
+	})
+	Describe("reconnect with clean session", func() {
+		JustBeforeEach(func() {
+			broker.Publish(topic, []byte("1"))
+		})
+		It("discards the previous session", func() {
+			Expect(connect(true).SessionPresent).To(BeFalse())
+			Expect(readAll()).To(BeEmpty())
+		})
+	})
+	Describe("offline queue", func() {
+		BeforeEach(func() {
+			config.Config.OfflineQueueSize = 2
+		})
+		JustBeforeEach(func() {
+			broker.Publish(topic, []byte("1"))
+			broker.Publish(topic, []byte("2"))
+			broker.Publish(topic, []byte("3"))
+		})
+		It("drops the oldest messages when it is full", func() {
+			connect(false)
+			received := readAll()
+
+			Expect(len(received)).To(Equal(2))
+			Expect(received[0].Payload).To(Equal([]byte("2")))
+			Expect(received[1].Payload).To(Equal([]byte("3")))
+		})
+	})
+	Describe("expiry", func() {
+		BeforeEach(func() {
+			config.Config.SessionExpiry = time.Millisecond * 10
+		})
+		JustBeforeEach(func() {
+			time.Sleep(time.Millisecond * 50)
+		})
+		It("discards the session after the expiry interval", func() {
+			Expect(connect(false).SessionPresent).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,262 @@
+package mqtt
+
+import (
+	"fmt"
+	"time"
+)
+
+// property identifiers of MQTT 5.0
+const (
+	propPayloadFormat        = 0x01
+	propMessageExpiry        = 0x02
+	propContentType          = 0x03
+	propResponseTopic        = 0x08
+	propCorrelationData      = 0x09
+	propSubscriptionID       = 0x0B
+	propSessionExpiry        = 0x11
+	propAssignedClientID     = 0x12
+	propServerKeepAlive      = 0x13
+	propAuthMethod           = 0x15
+	propAuthData             = 0x16
+	propRequestProblemInfo   = 0x17
+	propWillDelay            = 0x18
+	propRequestResponseInfo  = 0x19
+	propResponseInfo         = 0x1A
+	propServerReference      = 0x1C
+	propReasonString         = 0x1F
+	propReceiveMaximum       = 0x21
+	propTopicAliasMaximum    = 0x22
+	propTopicAlias           = 0x23
+	propMaximumQos           = 0x24
+	propRetainAvailable      = 0x25
+	propUser                 = 0x26
+	propMaximumPacketSize    = 0x27
+	propWildcardSubAvailable = 0x28
+	propSubIDAvailable       = 0x29
+	propSharedSubAvailable   = 0x2A
+)
+
+// UserProperty is a name/value pair sent by MQTT 5 clients. Names may occur more than once.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties of an MQTT 5 packet. Pointer fields are nil and other fields empty if the property is absent.
+// Properties the broker does not act on, such as the will delay or the server reference, are skipped when decoding.
+type Properties struct {
+	PayloadFormat   *byte
+	MessageExpiry   *uint32 // seconds
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	SubscriptionIDs []uint32
+	User            []UserProperty
+
+	SessionExpiry     *uint32 // seconds
+	ReceiveMaximum    *uint16
+	MaximumPacketSize *uint32
+	TopicAliasMaximum *uint16
+	TopicAlias        *uint16
+	ServerKeepAlive   *uint16
+	AssignedClientID  string
+	ReasonString      string
+	AuthMethod        string
+
+	// expiresAt is set by the broker when a message with MessageExpiry is published
+	expiresAt time.Time
+}
+
+// Uint32 returns a pointer to v for the optional integer properties
+func Uint32(v uint32) *uint32 {
+	return &v
+}
+
+// Uint16 returns a pointer to v for the optional integer properties
+func Uint16(v uint16) *uint16 {
+	return &v
+}
+
+// Byte returns a pointer to v for the optional byte properties
+func Byte(v byte) *byte {
+	return &v
+}
+
+// message returns the properties of a PUBLISH packet that are forwarded to subscribers.
+// Message expiry is counted from now.
+func (p *Properties) message(now time.Time) *Properties {
+	if p == nil {
+		return nil
+	}
+
+	m := &Properties{
+		PayloadFormat:   p.PayloadFormat,
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		User:            p.User,
+	}
+	if p.MessageExpiry != nil {
+		m.expiresAt = now.Add(time.Duration(*p.MessageExpiry) * time.Second)
+	}
+	return m
+}
+
+// expired returns true if the message expiry interval has passed
+func (p *Properties) expired(now time.Time) bool {
+	return p != nil && !p.expiresAt.IsZero() && !now.Before(p.expiresAt)
+}
+
+// forward returns a copy of the message properties with the remaining expiry interval
+func (p *Properties) forward(now time.Time) *Properties {
+	if p == nil || p.expiresAt.IsZero() {
+		return p
+	}
+
+	f := *p
+	remaining := (p.expiresAt.Sub(now) + time.Second - 1) / time.Second
+	f.MessageExpiry = Uint32(uint32(remaining))
+	return &f
+}
+
+func (p *Properties) decode(d *decoder) {
+	length := d.readVarint()
+	if d.err != nil {
+		return
+	}
+
+	if int(length) > len(d.buf) {
+		d.fail()
+		return
+	}
+	pd := &decoder{buf: d.buf[:length]}
+	d.buf = d.buf[length:]
+
+	for len(pd.buf) > 0 && pd.err == nil {
+		switch id := pd.readByte(); id {
+		case propPayloadFormat:
+			p.PayloadFormat = Byte(pd.readByte())
+		case propMessageExpiry:
+			p.MessageExpiry = Uint32(pd.readUint32())
+		case propContentType:
+			p.ContentType = pd.readString()
+		case propResponseTopic:
+			p.ResponseTopic = pd.readString()
+		case propCorrelationData:
+			p.CorrelationData = pd.readBinary()
+		case propSubscriptionID:
+			p.SubscriptionIDs = append(p.SubscriptionIDs, pd.readVarint())
+		case propSessionExpiry:
+			p.SessionExpiry = Uint32(pd.readUint32())
+		case propAssignedClientID:
+			p.AssignedClientID = pd.readString()
+		case propServerKeepAlive:
+			p.ServerKeepAlive = Uint16(pd.readUint16())
+		case propAuthMethod:
+			p.AuthMethod = pd.readString()
+		case propReasonString:
+			p.ReasonString = pd.readString()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = Uint16(pd.readUint16())
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = Uint16(pd.readUint16())
+		case propTopicAlias:
+			p.TopicAlias = Uint16(pd.readUint16())
+		case propUser:
+			p.User = append(p.User, UserProperty{Key: pd.readString(), Value: pd.readString()})
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = Uint32(pd.readUint32())
+		case propRequestProblemInfo, propRequestResponseInfo, propMaximumQos, propRetainAvailable,
+			propWildcardSubAvailable, propSubIDAvailable, propSharedSubAvailable:
+			pd.readByte()
+		case propWillDelay:
+			pd.readUint32()
+		case propResponseInfo, propServerReference:
+			pd.readString()
+		case propAuthData:
+			pd.readBinary()
+		default:
+			pd.err = fmt.Errorf("unknown property identifier 0x%02x", id)
+		}
+	}
+
+	if pd.err != nil {
+		d.err = pd.err
+	}
+}
+
+func (p *Properties) encode(e *encoder) {
+	var pe encoder
+
+	if p != nil {
+		if p.PayloadFormat != nil {
+			pe.WriteByte(propPayloadFormat)
+			pe.WriteByte(*p.PayloadFormat)
+		}
+		if p.MessageExpiry != nil {
+			pe.WriteByte(propMessageExpiry)
+			pe.writeUint32(*p.MessageExpiry)
+		}
+		if len(p.ContentType) > 0 {
+			pe.WriteByte(propContentType)
+			pe.writeString(p.ContentType)
+		}
+		if len(p.ResponseTopic) > 0 {
+			pe.WriteByte(propResponseTopic)
+			pe.writeString(p.ResponseTopic)
+		}
+		if p.CorrelationData != nil {
+			pe.WriteByte(propCorrelationData)
+			pe.writeBinary(p.CorrelationData)
+		}
+		for _, id := range p.SubscriptionIDs {
+			pe.WriteByte(propSubscriptionID)
+			pe.writeVarint(id)
+		}
+		if p.SessionExpiry != nil {
+			pe.WriteByte(propSessionExpiry)
+			pe.writeUint32(*p.SessionExpiry)
+		}
+		if len(p.AssignedClientID) > 0 {
+			pe.WriteByte(propAssignedClientID)
+			pe.writeString(p.AssignedClientID)
+		}
+		if p.ServerKeepAlive != nil {
+			pe.WriteByte(propServerKeepAlive)
+			pe.writeUint16(*p.ServerKeepAlive)
+		}
+		if len(p.AuthMethod) > 0 {
+			pe.WriteByte(propAuthMethod)
+			pe.writeString(p.AuthMethod)
+		}
+		if len(p.ReasonString) > 0 {
+			pe.WriteByte(propReasonString)
+			pe.writeString(p.ReasonString)
+		}
+		if p.ReceiveMaximum != nil {
+			pe.WriteByte(propReceiveMaximum)
+			pe.writeUint16(*p.ReceiveMaximum)
+		}
+		if p.TopicAliasMaximum != nil {
+			pe.WriteByte(propTopicAliasMaximum)
+			pe.writeUint16(*p.TopicAliasMaximum)
+		}
+		if p.TopicAlias != nil {
+			pe.WriteByte(propTopicAlias)
+			pe.writeUint16(*p.TopicAlias)
+		}
+		for _, u := range p.User {
+			pe.WriteByte(propUser)
+			pe.writeString(u.Key)
+			pe.writeString(u.Value)
+		}
+		if p.MaximumPacketSize != nil {
+			pe.WriteByte(propMaximumPacketSize)
+			pe.writeUint32(*p.MaximumPacketSize)
+		}
+	}
+
+	e.writeVarint(uint32(pe.Len()))
+	e.Write(pe.Bytes())
+}
@@ -0,0 +1,216 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = time.Second * 10
+
+// v1 headers are at most 107 bytes including CRLF
+const proxyV1MaxLength = 107
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyListener accepts connections that start with a PROXY protocol v1 or v2 header,
+// as sent by HAProxy and most TCP load balancers
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept does not wait for the header. It is read on the first call to Read or RemoteAddr of the connection.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reports the client address from the PROXY header as its remote address
+type proxyConn struct {
+	net.Conn
+
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	l            sync.Mutex
+	readDeadline time.Time
+}
+
+// Read returns the data following the PROXY header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address from the PROXY header or the address of the
+// load balancer if the header does not contain one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SetReadDeadline remembers the deadline, so that it can be restored after the header has been read
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetDeadline ...
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *proxyConn) readHeader() {
+	c.l.Lock()
+	deadline := c.readDeadline
+	if deadline.IsZero() || time.Until(deadline) > proxyHeaderTimeout {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	}
+	c.l.Unlock()
+
+	defer func() {
+		c.l.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.l.Unlock()
+	}()
+
+	c.remoteAddr, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader returns the source address of a PROXY protocol v1 or v2 header.
+// The address is nil for v1 UNKNOWN and v2 LOCAL headers and for address families other than TCP over IPv4 and IPv6.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if prefix, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(prefix, proxyV1Prefix) {
+		return nil, errInvalidProxyHeader
+	}
+	return readProxyV1Header(r)
+}
+
+// readProxyV1Header parses e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n"
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLength {
+			return nil, errInvalidProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+const (
+	proxyV2Version   = 0x20
+	proxyV2CmdLocal  = 0x00
+	proxyV2CmdProxy  = 0x01
+	proxyV2FamilyIn  = 0x10
+	proxyV2FamilyIn6 = 0x20
+)
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	addrs := make([]byte, length)
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	if verCmd&0xF0 != proxyV2Version {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	switch verCmd & 0x0F {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	// source address, destination address, source port, destination port
+	switch family & 0xF0 {
+	case proxyV2FamilyIn:
+		if len(addrs) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case proxyV2FamilyIn6:
+		if len(addrs) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	return nil, nil
+}
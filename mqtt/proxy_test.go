@@ -0,0 +1,118 @@
+package mqtt_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/mqtt"
+)
+
+var _ = Describe("PROXY protocol", func() {
+
+	var server *mqtt.Server
+	var remoteAddrs chan net.Addr
+	var conn net.Conn
+
+	BeforeEach(func() {
+		remoteAddrs = make(chan net.Addr, 1)
+		server = mqtt.NewServer("127.0.0.1:0", func(session *mqtt.Session) {
+			if _, err := session.ReadConnect(); err != nil {
+				return
+			}
+
+			remoteAddrs <- session.RemoteAddr()
+			session.AcknowledgeConnect(false)
+			session.Close()
+		})
+		server.SetProxyProtocol(true)
+		go server.Run()
+		Eventually(server.Addr).ShouldNot(BeNil())
+
+		var err error
+		conn, err = net.Dial("tcp", server.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		conn.Close()
+		Expect(server.Shutdown(context.Background())).To(Succeed())
+	})
+
+	// connect sends the header and CONNECT in one write and returns the address seen by the session handler
+	connect := func(header []byte) net.Addr {
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "1.marsara"
+		conPkg.Keepalive = 30
+
+		client := mqtt.NewSession(&prefixConn{Conn: conn, prefix: header}, time.Second)
+		Expect(client.Write(conPkg)).NotTo(HaveOccurred())
+
+		p, err := client.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(BeAssignableToTypeOf(&packets.ConnackPacket{}))
+
+		var addr net.Addr
+		Eventually(remoteAddrs).Should(Receive(&addr))
+		return addr
+	}
+
+	It("uses the source address of a v1 header", func() {
+		addr := connect([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n"))
+		Expect(addr.String()).To(Equal("192.0.2.1:56324"))
+	})
+	It("uses the source address of a v1 header with IPv6", func() {
+		addr := connect([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"))
+		Expect(addr.String()).To(Equal("[2001:db8::1]:56324"))
+	})
+	It("uses the address of the load balancer for v1 UNKNOWN", func() {
+		addr := connect([]byte("PROXY UNKNOWN\r\n"))
+		Expect(addr.String()).To(Equal(conn.LocalAddr().String()))
+	})
+	It("uses the source address of a v2 header", func() {
+		header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+		header = append(header, 0x21, 0x11, 0, 12)
+		header = append(header, 192, 0, 2, 1, 198, 51, 100, 1)
+		header = append(header, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-4:], 56324)
+		binary.BigEndian.PutUint16(header[len(header)-2:], 1883)
+
+		addr := connect(header)
+		Expect(addr.String()).To(Equal("192.0.2.1:56324"))
+	})
+	It("uses the address of the load balancer for v2 LOCAL", func() {
+		header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0, 0)
+		addr := connect(header)
+		Expect(addr.String()).To(Equal(conn.LocalAddr().String()))
+	})
+	It("closes connections without a header", func() {
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "1.marsara"
+		client := mqtt.NewSession(conn, time.Second)
+		Expect(client.Write(conPkg)).NotTo(HaveOccurred())
+
+		_, err := client.Read()
+		Expect(err).To(HaveOccurred())
+		Consistently(remoteAddrs).ShouldNot(Receive())
+	})
+})
+
+// prefixConn sends prefix in front of the first write
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Write(b []byte) (int, error) {
+	if c.prefix != nil {
+		b = append(c.prefix, b...)
+		n, err := c.Conn.Write(b)
+		n -= len(c.prefix)
+		c.prefix = nil
+		return n, err
+	}
+	return c.Conn.Write(b)
+}
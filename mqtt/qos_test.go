@@ -0,0 +1,350 @@
+package mqtt_test
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("QoS 1", func() {
+
+	var brokerSession, subscriberSession *mqtt.Session
+	var broker *mqtt.Broker
+	var topic = "pylon/1.marsara/ota/sysupgrade"
+
+	connect := func(clientID string, cleanSession bool) {
+		go broker.HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = clientID
+		conPkg.CleanSession = cleanSession
+		Expect(subscriberSession.Write(conPkg)).NotTo(HaveOccurred())
+
+		_, err := subscriberSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	subscribe := func(qos byte) *packets.SubackPacket {
+		subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subPkg.Topics = []string{"pylon/1.marsara/#"}
+		subPkg.Qoss = []byte{qos}
+		subPkg.MessageID = 1337
+		Expect(subscriberSession.Write(subPkg)).NotTo(HaveOccurred())
+
+		p, err := subscriberSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		subAck, ok := p.(*packets.SubackPacket)
+		Expect(ok).To(BeTrue())
+		return subAck
+	}
+
+	readPublish := func() *packets.PublishPacket {
+		p, err := subscriberSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		pubPkg, ok := p.(*packets.PublishPacket)
+		Expect(ok).To(BeTrue())
+		return pubPkg
+	}
+
+	BeforeEach(func() {
+		config.Config.RetryInterval = time.Millisecond * 100
+		brokerSession, subscriberSession = testutils.Pipe()
+		broker = mqtt.NewBroker(false)
+	})
+	AfterEach(func() {
+		config.Config.RetryInterval = 0
+		brokerSession.Close()
+		subscriberSession.Close()
+	})
+	Describe("subscribe", func() {
+		It("grants QoS 1", func() {
+			connect("control", true)
+			Expect(subscribe(1).ReturnCodes).To(Equal([]byte{1}))
+		})
+		It("grants QoS 2", func() {
+			connect("control", true)
+			Expect(subscribe(2).ReturnCodes).To(Equal([]byte{2}))
+		})
+	})
+	Describe("delivery", func() {
+		var first *packets.PublishPacket
+
+		BeforeEach(func() {
+			connect("control", true)
+			subscribe(1)
+
+			go broker.Publish(topic, []byte("{}"))
+			first = readPublish()
+		})
+		It("sends the message with QoS 1 and a message ID", func() {
+			Expect(first.Qos).To(Equal(byte(1)))
+			Expect(first.MessageID).NotTo(BeZero())
+			Expect(first.Dup).To(BeFalse())
+		})
+		It("redelivers the message with the DUP flag set if it is not acknowledged", func() {
+			dup := readPublish()
+			Expect(dup.Dup).To(BeTrue())
+			Expect(dup.MessageID).To(Equal(first.MessageID))
+			Expect(dup.Payload).To(Equal(first.Payload))
+		})
+		It("does not redeliver the message once it is acknowledged", func() {
+			pubAck := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pubAck.MessageID = first.MessageID
+			Expect(subscriberSession.Write(pubAck)).NotTo(HaveOccurred())
+
+			go func() {
+				time.Sleep(config.Config.RetryInterval * 3)
+				brokerSession.Close()
+			}()
+
+			pkg, err := subscriberSession.Read()
+			Expect(err).To(HaveOccurred())
+			Expect(pkg).To(BeNil())
+		})
+	})
+	Describe("reconnect", func() {
+		var first *packets.PublishPacket
+
+		BeforeEach(func() {
+			config.Config.RetryInterval = time.Hour
+			brokerSession, subscriberSession = testutils.Pipe()
+
+			connect("control", false)
+			subscribe(1)
+
+			go broker.Publish(topic, []byte("{}"))
+			first = readPublish()
+
+			// wait for the broker to remove the session
+			Expect(subscriberSession.Close()).NotTo(HaveOccurred())
+			time.Sleep(time.Millisecond * 10)
+
+			brokerSession, subscriberSession = testutils.Pipe()
+		})
+		It("redelivers unacknowledged messages with the DUP flag set", func() {
+			connect("control", false)
+
+			dup := readPublish()
+			Expect(dup.Dup).To(BeTrue())
+			Expect(dup.MessageID).To(Equal(first.MessageID))
+		})
+	})
+	Describe("in-flight limit", func() {
+		var received chan *packets.PublishPacket
+
+		BeforeEach(func() {
+			config.Config.RetryInterval = time.Hour
+			config.Config.MaxInflight = 5
+			brokerSession, subscriberSession = testutils.Pipe()
+
+			connect("control", true)
+			subscribe(1)
+
+			received = make(chan *packets.PublishPacket, 20)
+			go func(client *mqtt.Session, received chan<- *packets.PublishPacket) {
+				for {
+					p, err := client.Read()
+					if err != nil {
+						return
+					}
+					if pubPkg, ok := p.(*packets.PublishPacket); ok {
+						received <- pubPkg
+					}
+				}
+			}(subscriberSession, received)
+
+			for i := 0; i < 20; i++ {
+				broker.Publish(topic, []byte("{}"))
+			}
+		})
+		AfterEach(func() {
+			config.Config.MaxInflight = 0
+		})
+		It("stops sending to a client that never acknowledges", func() {
+			Eventually(received).Should(HaveLen(5))
+			Consistently(received).Should(HaveLen(5))
+		})
+		It("sends the next message once one is acknowledged", func() {
+			Eventually(received).Should(HaveLen(5))
+			first := <-received
+
+			pubAck := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pubAck.MessageID = first.MessageID
+			Expect(subscriberSession.Write(pubAck)).NotTo(HaveOccurred())
+
+			Eventually(received).Should(HaveLen(5))
+			Consistently(received).Should(HaveLen(5))
+		})
+	})
+	Describe("publish", func() {
+		var recorder *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(topic, recorder)
+			connect("control", true)
+		})
+		It("acknowledges PUBLISH packets with QoS 1", func() {
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = topic
+			pubPkg.Qos = 1
+			pubPkg.MessageID = 42
+			pubPkg.Payload = []byte("{}")
+			Expect(subscriberSession.Write(pubPkg)).NotTo(HaveOccurred())
+
+			p, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			pubAck, ok := p.(*packets.PubackPacket)
+			Expect(ok).To(BeTrue())
+			Expect(pubAck.MessageID).To(Equal(uint16(42)))
+			Expect(recorder.Count()).To(Equal(1))
+		})
+	})
+})
+
+var _ = Describe("QoS 2", func() {
+
+	var brokerSession, clientSession *mqtt.Session
+	var broker *mqtt.Broker
+	var topic = "pylon/1.marsara/ota/sysupgrade"
+
+	read := func() packets.ControlPacket {
+		p, err := clientSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+
+	BeforeEach(func() {
+		config.Config.RetryInterval = time.Millisecond * 100
+		brokerSession, clientSession = testutils.Pipe()
+		broker = mqtt.NewBroker(false)
+
+		go broker.HandleConnection(brokerSession)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "control"
+		Expect(clientSession.Write(conPkg)).NotTo(HaveOccurred())
+		read()
+	})
+	AfterEach(func() {
+		config.Config.RetryInterval = 0
+		brokerSession.Close()
+		clientSession.Close()
+	})
+	Describe("delivery", func() {
+		var pubPkg *packets.PublishPacket
+
+		BeforeEach(func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{topic}
+			subPkg.Qoss = []byte{2}
+			subPkg.MessageID = 1337
+			Expect(clientSession.Write(subPkg)).NotTo(HaveOccurred())
+			read()
+
+			go broker.Publish(topic, []byte("{}"))
+
+			var ok bool
+			pubPkg, ok = read().(*packets.PublishPacket)
+			Expect(ok).To(BeTrue())
+		})
+		It("sends the message with QoS 2", func() {
+			Expect(pubPkg.Qos).To(Equal(byte(2)))
+			Expect(pubPkg.MessageID).NotTo(BeZero())
+		})
+		It("redelivers the message if PUBREC is not received in time", func() {
+			dup, ok := read().(*packets.PublishPacket)
+			Expect(ok).To(BeTrue())
+			Expect(dup.Dup).To(BeTrue())
+			Expect(dup.MessageID).To(Equal(pubPkg.MessageID))
+		})
+		Context("after PUBREC", func() {
+			BeforeEach(func() {
+				pubRec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubRec.MessageID = pubPkg.MessageID
+				Expect(clientSession.Write(pubRec)).NotTo(HaveOccurred())
+			})
+			It("sends PUBREL", func() {
+				pubRel, ok := read().(*packets.PubrelPacket)
+				Expect(ok).To(BeTrue())
+				Expect(pubRel.MessageID).To(Equal(pubPkg.MessageID))
+			})
+			It("sends PUBREL again instead of the message if PUBCOMP is not received in time", func() {
+				read()
+
+				pubRel, ok := read().(*packets.PubrelPacket)
+				Expect(ok).To(BeTrue())
+				Expect(pubRel.MessageID).To(Equal(pubPkg.MessageID))
+			})
+			It("completes the flow on PUBCOMP", func() {
+				read()
+
+				pubComp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+				pubComp.MessageID = pubPkg.MessageID
+				Expect(clientSession.Write(pubComp)).NotTo(HaveOccurred())
+
+				go func() {
+					time.Sleep(config.Config.RetryInterval * 3)
+					brokerSession.Close()
+				}()
+
+				pkg, err := clientSession.Read()
+				Expect(err).To(HaveOccurred())
+				Expect(pkg).To(BeNil())
+			})
+		})
+	})
+	Describe("publish", func() {
+		var recorder *testutils.PubSubRecorder
+
+		publish := func(dup bool) {
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = topic
+			pubPkg.Qos = 2
+			pubPkg.Dup = dup
+			pubPkg.MessageID = 7
+			pubPkg.Payload = []byte("{}")
+			Expect(clientSession.Write(pubPkg)).NotTo(HaveOccurred())
+
+			pubRec, ok := read().(*packets.PubrecPacket)
+			Expect(ok).To(BeTrue())
+			Expect(pubRec.MessageID).To(Equal(uint16(7)))
+		}
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(topic, recorder)
+			publish(false)
+		})
+		It("forwards the message once", func() {
+			publish(true)
+			Expect(recorder.Count()).To(Equal(1))
+		})
+		It("responds to PUBREL with PUBCOMP", func() {
+			pubRel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubRel.MessageID = 7
+			Expect(clientSession.Write(pubRel)).NotTo(HaveOccurred())
+
+			pubComp, ok := read().(*packets.PubcompPacket)
+			Expect(ok).To(BeTrue())
+			Expect(pubComp.MessageID).To(Equal(uint16(7)))
+		})
+		It("forwards a new message with the same ID after the flow completed", func() {
+			pubRel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubRel.MessageID = 7
+			Expect(clientSession.Write(pubRel)).NotTo(HaveOccurred())
+			read()
+
+			publish(false)
+			Expect(recorder.Count()).To(Equal(2))
+		})
+	})
+})
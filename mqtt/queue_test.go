@@ -0,0 +1,95 @@
+package mqtt_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Outbound queue", func() {
+
+	var brokerSession, subscriberSession *mqtt.Session
+	var broker *mqtt.Broker
+	var policy mqtt.OverflowPolicy
+	var topic = "pylon/1.marsara/up"
+
+	// publish sends the first message, waits until it blocks the writer and then sends the rest
+	publish := func(n int) {
+		broker.Publish(topic, []byte("0"))
+		time.Sleep(time.Millisecond * 10)
+
+		for i := 1; i < n; i++ {
+			broker.Publish(topic, []byte(fmt.Sprint(i)))
+		}
+	}
+
+	read := func(n int) []string {
+		res := []string{}
+		for i := 0; i < n; i++ {
+			p, err := subscriberSession.Read()
+			if err != nil {
+				break
+			}
+			res = append(res, string(p.(*packets.PublishPacket).Payload))
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		policy = mqtt.DropOldest
+	})
+	JustBeforeEach(func() {
+		config.Config.QueueSize = 2
+		config.Config.QueueOverflow = string(policy)
+
+		brokerSession, subscriberSession = testutils.Pipe()
+		broker = mqtt.NewBroker(false)
+		broker.Subscribe(topic, brokerSession)
+	})
+	AfterEach(func() {
+		config.Config.QueueSize = 0
+		config.Config.QueueOverflow = ""
+
+		brokerSession.Close()
+		subscriberSession.Close()
+	})
+	It("does not block the publisher when the subscriber does not read", func() {
+		done := make(chan struct{})
+		go func() {
+			publish(10)
+			close(done)
+		}()
+
+		Eventually(done).Should(BeClosed())
+	})
+	It("drops the oldest queued messages", func() {
+		publish(5)
+		Expect(read(3)).To(Equal([]string{"0", "3", "4"}))
+	})
+	Context("with drop-newest", func() {
+		BeforeEach(func() {
+			policy = mqtt.DropNewest
+		})
+		It("drops the new messages", func() {
+			publish(5)
+			Expect(read(3)).To(Equal([]string{"0", "1", "2"}))
+		})
+	})
+	Context("with disconnect", func() {
+		BeforeEach(func() {
+			policy = mqtt.Disconnect
+		})
+		It("closes the connection", func() {
+			publish(5)
+
+			_, err := subscriberSession.Read()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,33 @@
+package mqtt
+
+// Names of the listeners messages are recorded with
+const (
+	ListenerDevices  = "devices"
+	ListenerControl  = "control"
+	ListenerInternal = "internal" // messages published by spire itself
+)
+
+// Recorder records the messages published through the broker. Record is called synchronously
+// by the publisher and must not block. retained is set for messages published as retained.
+type Recorder interface {
+	Record(listener, clientID, topic string, message interface{}, retained bool)
+}
+
+// SetRecorder passes every message published through the broker to r.
+// It must be called before the broker is used.
+func (b *Broker) SetRecorder(r Recorder) {
+	b.recorder = r
+}
+
+// record passes the message to the recorder. Messages without a session are recorded as internal.
+func (b *Broker) record(session *Session, topic string, message interface{}, retained bool) {
+	if b.recorder == nil {
+		return
+	}
+
+	listener, clientID := ListenerInternal, ""
+	if session != nil {
+		listener, clientID = session.Listener(), session.ClientID()
+	}
+	b.recorder.Record(listener, clientID, topic, message, retained)
+}
@@ -1,11 +1,12 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"os"
+	"sync"
 
 	bugsnag "github.com/bugsnag/bugsnag-go"
 	bugsnagErrors "github.com/bugsnag/bugsnag-go/errors"
@@ -18,8 +19,14 @@ type SessionHandler func(*Session)
 // Server ...
 type Server struct {
 	bind        string
-	listener    net.Listener
+	tlsConfig   *tls.Config
 	sessHandler SessionHandler
+	sessions    *sessionGroup
+
+	proxyProtocol bool
+
+	l        sync.Mutex
+	listener net.Listener
 }
 
 // NewServer instantiates a new server that listens on the address passed in "bind"
@@ -31,40 +38,115 @@ func NewServer(bind string, sessHandler SessionHandler) *Server {
 	return &Server{
 		bind:        bind,
 		sessHandler: sessHandler,
+		sessions:    newSessionGroup(),
+	}
+}
+
+// NewTLSServer instantiates a new server that accepts TLS connections on the address passed in "bind"
+func NewTLSServer(bind string, tlsConfig *tls.Config, sessHandler SessionHandler) *Server {
+	s := NewServer(bind, sessHandler)
+	if s != nil {
+		s.tlsConfig = tlsConfig
 	}
+	return s
 }
 
-// Run ...
-func (s *Server) Run() {
-	var err error
-	if s.listener, err = net.Listen("tcp", s.bind); err != nil {
-		log.Println(err)
+// Run accepts connections until Shutdown is called, in which case it returns ErrServerClosed.
+// Any other error means the server could not listen on its address.
+func (s *Server) Run() error {
+	listener, err := net.Listen("tcp", s.bind)
+	if err != nil {
 		notifyBugsnagSync(err, "spire:createListener", bugsnag.MetaData{"Listen": {"Bind": s.bind}})
-		os.Exit(1)
+		return err
+	}
+
+	if s.proxyProtocol {
+		listener = &proxyListener{listener}
+	}
+
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+		log.Println("listening on", s.bind, "(TLS)")
+	} else {
+		log.Println("listening on", s.bind)
+	}
+
+	s.l.Lock()
+	s.listener = listener
+	closed := s.sessions.isClosed()
+	s.l.Unlock()
+
+	if closed {
+		listener.Close()
+		return ErrServerClosed
 	}
 
-	log.Println("listening on", s.bind)
 	for {
-		if conn, err := s.listener.Accept(); err != nil && err != io.EOF {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.sessions.isClosed() {
+				return ErrServerClosed
+			}
+
 			log.Println(err)
-		} else {
-			go s.handleSession(conn)
+			continue
 		}
+
+		go s.sessions.serve(conn, s.sessHandler)
 	}
 }
 
-func (s *Server) handleSession(conn net.Conn) {
+// Addr returns the address the server listens on or nil if it is not listening yet
+func (s *Server) Addr() net.Addr {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// SetLimits restricts the connections the server accepts. It must be called before Run.
+func (s *Server) SetLimits(limits Limits) {
+	s.sessions.setLimits(limits)
+}
+
+// SetProxyProtocol makes the server expect a PROXY protocol v1 or v2 header at the start of each connection,
+// so that Session.RemoteAddr() returns the address of the client instead of the one of the load balancer.
+// It must be called before Run.
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.proxyProtocol = enabled
+}
+
+// Shutdown stops accepting connections and sends DISCONNECT to connected clients in batches
+// of config.Config.ShutdownBatchSize, one batch every config.Config.ShutdownBatchInterval.
+// It returns when all session handlers have returned or when ctx is done. In the latter case
+// the remaining connections are closed and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	sessions := s.sessions.close()
+
+	s.l.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.l.Unlock()
+
+	return s.sessions.disconnect(ctx, sessions)
+}
+
+func handleSession(session *Session, sessHandler SessionHandler) {
 	defer func() {
 		if err := recover(); err != nil {
 			metadata := bugsnag.MetaData{"Client": {
-				"IP Address": fmt.Sprintf("%v", conn.RemoteAddr())},
+				"IP Address": fmt.Sprintf("%v", session.RemoteAddr())},
 			}
 
 			notifyBugsnag(err, "spire:mqttSession", metadata)
 		}
 	}()
 
-	s.sessHandler(NewSession(conn, config.Config.IdleConnectionTimeout))
+	sessHandler(session)
 }
 
 func notifyBugsnag(err interface{}, ctx string, metadata bugsnag.MetaData) {
@@ -1,35 +1,186 @@
 package mqtt
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/superscale/spire/config"
 	"github.com/superscale/spire/monitoring"
 )
 
+// MaxQos is the highest QoS level the broker grants to subscribers
+const MaxQos byte = 2
+
+// SubackFailure is the SUBACK return code for topic filters the broker refuses
+const SubackFailure byte = 0x80
+
+const defaultRetryInterval = time.Second * 20
+const defaultKeepAliveMin = time.Second * 10
+const defaultKeepAliveMax = time.Minute * 30
+const defaultQueueSize = 1000
+const defaultMaxInflight = 100
+
+// maxPacketIDs is the number of message IDs available for QoS 1 and QoS 2 messages
+const maxPacketIDs = 65535
+
+// OverflowPolicy determines what happens to messages for a session whose outbound queue is full
+type OverflowPolicy string
+
+const (
+	// DropOldest removes the oldest queued message to make room for the new one
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest discards the new message
+	DropNewest OverflowPolicy = "drop-newest"
+	// Disconnect closes the connection to the client
+	Disconnect OverflowPolicy = "disconnect"
+)
+
 // Session represents an MQTT connection
 type Session struct {
-	conn        net.Conn
-	idleTimeout time.Duration
+	conn          net.Conn
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	retryInterval time.Duration
+
+	clientID     string
+	cleanSession bool // discard the state of a previous session on connect
+	persistent   bool // keep the state of the session after disconnect
+	will         *packets.PublishPacket
+	willProps    *Properties
+	version      byte
+	connectProps *Properties
+	expiry       time.Duration // session expiry interval of MQTT 5 clients, 0 for the default of the broker
+
+	l          sync.Mutex
+	ids        *packetIDState
+	grantedQos map[string]byte
+	retrying   bool
+	closed     bool
+	takenOver  bool
+
+	user     *User
+	listener string
+
+	onHandshake   func() // called once the CONNECT packet has been answered
+	handshakeOnce sync.Once
+
+	queue          []queuedMessage
+	queueSize      int
+	maxInflight    int
+	overflowPolicy OverflowPolicy
+	flushed        chan struct{}
+}
+
+// packetIDState holds the QoS 1 and QoS 2 message flows of a session.
+// It is kept in an offlineSession when a client without the clean session flag disconnects.
+type packetIDState struct {
+	nextID   uint16
+	outbound map[uint16]*inflightMessage
+	inbound  map[uint16]bool // QoS 2 message IDs received but not yet released
+}
+
+type inflightMessage struct {
+	pkg      *packets.PublishPacket
+	props    *Properties
+	released bool // PUBREC received and PUBREL sent
+	sentAt   time.Time
+}
+
+func newPacketIDState() *packetIDState {
+	return &packetIDState{
+		outbound: make(map[uint16]*inflightMessage),
+		inbound:  make(map[uint16]bool),
+	}
 }
 
-// NewSession returns a new mqtt.Session
+// NewSession returns a new mqtt.Session. idleTimeout is the read timeout until the CONNECT packet
+// has been received. It is also the write timeout unless config.Config.WriteTimeout is set.
 func NewSession(conn net.Conn, idleTimeout time.Duration) *Session {
+	writeTimeout := config.Config.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = idleTimeout
+	}
+
+	retryInterval := config.Config.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = defaultRetryInterval
+	}
+
+	queueSize := config.Config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	maxInflight := config.Config.MaxInflight
+	if maxInflight <= 0 {
+		maxInflight = defaultMaxInflight
+	}
+	if maxInflight > maxPacketIDs {
+		maxInflight = maxPacketIDs
+	}
+
 	return &Session{
-		conn:        conn,
-		idleTimeout: idleTimeout,
+		conn:           conn,
+		readTimeout:    idleTimeout,
+		writeTimeout:   writeTimeout,
+		retryInterval:  retryInterval,
+		cleanSession:   true,
+		ids:            newPacketIDState(),
+		grantedQos:     make(map[string]byte),
+		queue:          []queuedMessage{},
+		queueSize:      queueSize,
+		maxInflight:    maxInflight,
+		overflowPolicy: parseOverflowPolicy(config.Config.QueueOverflow),
+	}
+}
+
+func parseOverflowPolicy(policy string) OverflowPolicy {
+	switch p := OverflowPolicy(policy); p {
+	case DropOldest, DropNewest, Disconnect:
+		return p
+	case "":
+		return DropOldest
+	default:
+		log.Printf("unknown queue overflow policy %q. using %q", policy, DropOldest)
+		return DropOldest
 	}
 }
 
-// ReadConnect reads the connect packet or times out
+// ReadConnect reads the connect packet or times out.
+// The protocol level of the packet selects the codec for the rest of the session: MQTT 5 clients
+// get MQTT 5 packets, everyone else gets 3.1.1 packets. For MQTT 5 clients the clean session flag is
+// the clean start flag, and the session is kept after disconnect if the session expiry interval is not 0.
+// The receive maximum of MQTT 5 clients lowers the in-flight limit of the session.
 func (s *Session) ReadConnect() (p *packets.ConnectPacket, err error) {
-	s.conn.SetReadDeadline(s.deadline())
+	s.conn.SetReadDeadline(s.readDeadline())
+
+	header, body, err := readRawPacket(s.conn)
+	if err != nil {
+		return
+	}
 
 	var ca packets.ControlPacket
-	if ca, err = packets.ReadPacket(s.conn); err != nil {
+	var props, willProps *Properties
+
+	if header>>4 == packets.Connect && connectProtocolLevel(body) == ProtocolVersion5 {
+		ca, props, willProps, err = decodePacketV5(header, body)
+	} else {
+		var raw encoder
+		raw.WriteByte(header)
+		raw.writeVarint(uint32(len(body)))
+		raw.Write(body)
+		ca, err = packets.ReadPacket(&raw)
+	}
+	if err != nil {
 		return
 	}
 
@@ -38,14 +189,152 @@ func (s *Session) ReadConnect() (p *packets.ConnectPacket, err error) {
 		return nil, fmt.Errorf("expected a CONNECT packet from %v, got this instead: %s", s.conn.RemoteAddr(), ca.String())
 	}
 
+	s.clientID = p.ClientIdentifier
+	s.cleanSession = p.CleanSession
+	s.persistent = !p.CleanSession
+	s.readTimeout = keepAliveTimeout(p.Keepalive)
+
+	s.version = p.ProtocolVersion
+	if props != nil {
+		s.connectProps = props
+		s.persistent = props.SessionExpiry != nil && *props.SessionExpiry > 0
+		if props.SessionExpiry != nil {
+			// 0xFFFFFFFF means the session does not expire, which is 136 years here
+			s.expiry = time.Duration(*props.SessionExpiry) * time.Second
+		}
+		if props.ReceiveMaximum != nil && *props.ReceiveMaximum > 0 && int(*props.ReceiveMaximum) < s.maxInflight {
+			s.maxInflight = int(*props.ReceiveMaximum)
+		}
+	}
+
+	if p.WillFlag {
+		s.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		s.will.TopicName = p.WillTopic
+		s.will.Payload = p.WillMessage
+		s.will.Qos = p.WillQos
+		s.will.Retain = p.WillRetain
+		s.willProps = willProps
+	}
 	return
 }
 
-// AcknowledgeConnect ...
-func (s *Session) AcknowledgeConnect() error {
+// ProtocolVersion returns the protocol level the client sent in CONNECT: 3 for MQTT 3.1, 4 for 3.1.1 and 5 for 5.0.
+// It is 0 until ReadConnect has been called.
+func (s *Session) ProtocolVersion() byte {
+	return s.version
+}
+
+// ConnectProperties returns the properties of the CONNECT packet, or nil if the client does not speak MQTT 5
+func (s *Session) ConnectProperties() *Properties {
+	return s.connectProps
+}
+
+// AcknowledgeConnect sends CONNACK. sessionPresent tells the client whether
+// the broker resumes the state of a previous session. If CONNACK cannot be sent, the session
+// is not kept after disconnect, so that the state of the previous session stays untouched.
+func (s *Session) AcknowledgeConnect(sessionPresent bool) error {
 	cAck := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	s.conn.SetWriteDeadline(s.deadline())
-	return cAck.Write(s.conn)
+	cAck.SessionPresent = sessionPresent
+	s.conn.SetWriteDeadline(s.writeDeadline())
+	err := s.write(cAck, nil)
+	if err != nil {
+		s.l.Lock()
+		s.persistent = false
+		s.l.Unlock()
+	}
+
+	s.endHandshake()
+	return err
+}
+
+// isPersistent returns true if the state of the session is kept after disconnect
+func (s *Session) isPersistent() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.persistent
+}
+
+// User returns the user the client authenticated as, or nil if the broker does not authenticate clients
+func (s *Session) User() *User {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.user
+}
+
+// SetUser sets the user whose ACLs apply to the session
+func (s *Session) SetUser(u *User) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.user = u
+}
+
+// Listener returns the name of the listener the session was accepted on
+func (s *Session) Listener() string {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.listener
+}
+
+// SetListener sets the name of the listener the session was accepted on. Messages of the client are recorded with it.
+func (s *Session) SetListener(name string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.listener = name
+}
+
+// RefuseConnect sends CONNACK with a return code other than packets.Accepted
+func (s *Session) RefuseConnect(returnCode byte) error {
+	cAck := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	cAck.ReturnCode = returnCode
+	s.conn.SetWriteDeadline(s.writeDeadline())
+	err := s.write(cAck, nil)
+
+	s.endHandshake()
+	return err
+}
+
+// endHandshake calls onHandshake the first time it is invoked
+func (s *Session) endHandshake() {
+	s.handshakeOnce.Do(func() {
+		if s.onHandshake != nil {
+			s.onHandshake()
+		}
+	})
+}
+
+// PeerCertificates returns the verified certificate chain the client presented
+// during the TLS handshake, or nil if the connection does not use TLS
+func (s *Session) PeerCertificates() []*x509.Certificate {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	return conn.ConnectionState().PeerCertificates
+}
+
+// handshakeTLS completes the TLS handshake of connections that use TLS. Failed handshakes are counted
+// as rejected certificates, except when the client closes the connection without one.
+func (s *Session) handshakeTLS() error {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	conn.SetDeadline(s.readDeadline())
+	defer conn.SetDeadline(time.Time{})
+
+	err := conn.Handshake()
+	if err != nil && err != io.EOF {
+		log.Printf("TLS handshake with %v failed: %v", s.RemoteAddr(), err)
+		monitoring.CountRejectedConnection("certificate")
+	}
+	return err
 }
 
 // Handshake performs the connection handshake and returns the connect packet or an error
@@ -54,28 +343,186 @@ func (s *Session) Handshake() (p *packets.ConnectPacket, err error) {
 		return
 	}
 
-	if err = s.AcknowledgeConnect(); err != nil {
+	if err = s.AcknowledgeConnect(false); err != nil {
 		p = nil
 	}
 	return
 }
 
+// keepAliveTimeout returns 1.5 times the keep-alive interval a client sent in CONNECT, clamped to
+// the configured minimum and maximum. Clients that disable keep-alive get the maximum.
+func keepAliveTimeout(keepAlive uint16) time.Duration {
+	min := config.Config.KeepAliveMin
+	if min <= 0 {
+		min = defaultKeepAliveMin
+	}
+
+	max := config.Config.KeepAliveMax
+	if max <= 0 {
+		max = defaultKeepAliveMax
+	}
+
+	if keepAlive == 0 {
+		return max
+	}
+
+	timeout := time.Duration(keepAlive) * time.Second * 3 / 2
+	if timeout < min {
+		return min
+	}
+	if timeout > max {
+		return max
+	}
+	return timeout
+}
+
 // Close ...
+// Queued messages are flushed first, for at most the write timeout of the session.
 func (s *Session) Close() error {
+	s.flush()
 	return s.conn.Close()
 }
 
+// Disconnect flushes queued messages, sends DISCONNECT to the peer and closes the connection.
+// It is used by servers that shut down.
+func (s *Session) Disconnect() error {
+	s.flush()
+
+	s.Write(newDisconnect(reasonServerShuttingDown))
+	return s.conn.Close()
+}
+
+func newDisconnect(reason byte) *disconnectV5 {
+	return &disconnectV5{packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket), reason}
+}
+
+// flush marks the session as closed and waits for the queued messages to be written,
+// for at most the write timeout of the session
+func (s *Session) flush() {
+	s.l.Lock()
+	s.closed = true
+	flushed := s.flushed
+	s.l.Unlock()
+
+	if flushed != nil {
+		select {
+		case <-flushed:
+		case <-time.After(s.writeTimeout):
+		}
+	}
+}
+
+func (s *Session) isClosed() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.closed
+}
+
+// abort closes the connection without flushing queued messages
+func (s *Session) abort() error {
+	s.l.Lock()
+	s.closed = true
+	s.l.Unlock()
+
+	return s.conn.Close()
+}
+
+// terminate closes the connection without flushing queued messages. MQTT 5 clients are sent DISCONNECT
+// with reason first, in the background, so that a slow client does not hold up the caller.
+func (s *Session) terminate(reason byte) error {
+	if s.version != ProtocolVersion5 {
+		return s.abort()
+	}
+
+	s.l.Lock()
+	s.closed = true
+	s.l.Unlock()
+
+	go func() {
+		s.Write(newDisconnect(reason))
+		s.conn.Close()
+	}()
+	return nil
+}
+
 // RemoteAddr ...
 func (s *Session) RemoteAddr() net.Addr {
 	return s.conn.RemoteAddr()
 }
 
+// ClientID returns the client identifier sent in the CONNECT packet
+func (s *Session) ClientID() string {
+	return s.clientID
+}
+
+// CleanSession returns the value of the clean session flag sent in the CONNECT packet,
+// which is the clean start flag for MQTT 5 clients
+func (s *Session) CleanSession() bool {
+	return s.cleanSession
+}
+
+// TakenOver returns true if the session was closed because the client connected again
+func (s *Session) TakenOver() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.takenOver
+}
+
+func (s *Session) takeOver() {
+	s.l.Lock()
+	s.takenOver = true
+	s.will = nil
+	s.willProps = nil
+	s.l.Unlock()
+
+	s.terminate(reasonSessionTakenOver)
+}
+
+// DiscardWill drops the will message. It must be called when the client sends DISCONNECT.
+func (s *Session) DiscardWill() {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.will = nil
+	s.willProps = nil
+}
+
+func (s *Session) takeWill() (*packets.PublishPacket, *Properties) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	will, props := s.will, s.willProps
+	s.will, s.willProps = nil, nil
+	return will, props
+}
+
 // Read a packet or time out
+// It returns io.EOF if the connection was closed by this side.
 func (s *Session) Read() (pkg packets.ControlPacket, err error) {
-	s.conn.SetReadDeadline(s.deadline())
-	pkg, err = packets.ReadPacket(s.conn)
+	pkg, _, err = s.ReadWithProperties()
+	return
+}
+
+// ReadWithProperties reads a packet and, for MQTT 5 sessions, its properties.
+// The properties are nil for 3.1.1 sessions. PUBLISH packets with a topic alias are rejected,
+// because the broker does not grant any.
+func (s *Session) ReadWithProperties() (pkg packets.ControlPacket, props *Properties, err error) {
+	s.conn.SetReadDeadline(s.readDeadline())
+	if s.version == ProtocolVersion5 {
+		pkg, props, err = ReadPacketV5(s.conn)
+	} else {
+		pkg, err = packets.ReadPacket(s.conn)
+	}
+	if err != nil && s.isClosed() {
+		return nil, nil, io.EOF
+	}
 
 	if p, ok := pkg.(*packets.PublishPacket); ok {
+		if props != nil && props.TopicAlias != nil {
+			return nil, nil, fmt.Errorf("topic alias from %v is not supported", s.conn.RemoteAddr())
+		}
 		monitoring.CountMessageIngress(p.TopicName)
 	}
 	return
@@ -83,11 +530,31 @@ func (s *Session) Read() (pkg packets.ControlPacket, err error) {
 
 // Write a packet or time out
 func (s *Session) Write(pkg packets.ControlPacket) error {
-	if p, ok := pkg.(*packets.PublishPacket); ok {
+	switch p := pkg.(type) {
+	case *packets.PublishPacket:
+		monitoring.CountMessageEgress(p.TopicName)
+	case *publishV5:
 		monitoring.CountMessageEgress(p.TopicName)
 	}
 
-	s.conn.SetWriteDeadline(s.deadline())
+	s.conn.SetWriteDeadline(s.writeDeadline())
+	return s.write(pkg, nil)
+}
+
+// write encodes pkg for the protocol version of the session. Properties are dropped for 3.1.1 sessions.
+func (s *Session) write(pkg packets.ControlPacket, props *Properties) error {
+	if s.version == ProtocolVersion5 {
+		return WritePacketV5(s.conn, pkg, props)
+	}
+
+	switch p := pkg.(type) {
+	case *publishV5:
+		pkg = p.PublishPacket
+	case *unsubackV5:
+		pkg = p.UnsubackPacket
+	case *disconnectV5:
+		pkg = p.DisconnectPacket
+	}
 	return pkg.Write(s.conn)
 }
 
@@ -97,9 +564,20 @@ func (s *Session) SendPingresp() error {
 	return s.Write(resp)
 }
 
-// HandleMessage serializes the message to JSON (unless it is a []byte)
-// and sends a PUBLISH packet with QoS 0
+// HandleMessage serializes the message to JSON (unless it is a []byte) and queues a PUBLISH packet
+// with the highest QoS granted to a subscription matching topic. The packet is sent asynchronously.
 func (s *Session) HandleMessage(topic string, message interface{}) error {
+	return s.publish(topic, message, MaxQos, false, nil)
+}
+
+// publish queues the message with the lower one of qos and the QoS granted for topic.
+// If the queue is full, the overflow policy of the session is applied.
+// props are sent to MQTT 5 clients. Messages whose expiry interval has passed are dropped.
+func (s *Session) publish(topic string, message interface{}, qos byte, retain bool, props *Properties) error {
+	if props.expired(time.Now()) {
+		return nil
+	}
+
 	var payload []byte
 	var ok bool
 	var err error
@@ -112,28 +590,387 @@ func (s *Session) HandleMessage(topic string, message interface{}) error {
 		}
 	}
 
-	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-	p.Qos = 0
-	p.TopicName = topic
-	p.Payload = payload
+	s.l.Lock()
+	if granted := matchQos(s.grantedQos, topic); granted < qos {
+		qos = granted
+	}
+
+	if s.closed {
+		s.l.Unlock()
+		return nil
+	}
+
+	if len(s.queue) >= s.queueSize {
+		monitoring.CountMessageDropped(string(s.overflowPolicy))
+
+		switch s.overflowPolicy {
+		case DropNewest:
+			s.l.Unlock()
+			return nil
+		case Disconnect:
+			s.l.Unlock()
+			log.Printf("outbound queue of %v is full. closing connection", s.RemoteAddr())
+			return s.terminate(reasonQuotaExceeded)
+		default:
+			s.queue = s.queue[1:]
+		}
+	}
+
+	s.queue = append(s.queue, queuedMessage{topic: topic, message: payload, qos: qos, retain: retain, props: props})
+	s.startWriting()
+	s.l.Unlock()
 
-	return s.Write(p)
+	return nil
+}
+
+// startWriting runs the write loop unless it is already running or there is nothing to send.
+// s.l must be held by the caller.
+func (s *Session) startWriting() {
+	if s.flushed != nil || s.closed || len(s.queue) == 0 {
+		return
+	}
+
+	s.flushed = make(chan struct{})
+	go s.writeLoop(s.flushed)
+}
+
+// writeLoop sends queued messages until the queue is empty or a write fails. It also stops when the next
+// message has QoS 1 or QoS 2 and maxInflight messages are unacknowledged; the loop is started again when
+// the peer acknowledges one of them. flushed is closed when it returns.
+func (s *Session) writeLoop(flushed chan struct{}) {
+	defer close(flushed)
+
+	for {
+		s.l.Lock()
+		if len(s.queue) == 0 || (s.queue[0].qos > 0 && len(s.ids.outbound) >= s.maxInflight) {
+			s.flushed = nil
+			s.l.Unlock()
+			return
+		}
+
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+
+		now := time.Now()
+		if m.props.expired(now) {
+			s.l.Unlock()
+			continue
+		}
+
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = m.topic
+		p.Payload = m.message.([]byte)
+		p.Qos = m.qos
+		p.Retain = m.retain
+
+		var pkg packets.ControlPacket = p
+		if m.props != nil && s.version == ProtocolVersion5 {
+			props := m.props.forward(now)
+			pkg = &publishV5{p, props}
+			if p.Qos > 0 {
+				s.addInflight(p, props)
+			}
+		} else if p.Qos > 0 {
+			s.addInflight(p, nil)
+		}
+		s.l.Unlock()
+
+		if err := s.Write(pkg); err != nil {
+			if !s.isClosed() {
+				log.Printf("error while sending message to %v: %v", s.RemoteAddr(), err)
+			}
+
+			s.l.Lock()
+			s.flushed = nil
+			s.l.Unlock()
+			return
+		}
+	}
+}
+
+// MarkReceived records the message ID of a QoS 2 PUBLISH packet until it is released by the peer.
+// It returns false if the packet is a duplicate of a message that has already been received.
+func (s *Session) MarkReceived(pkg *packets.PublishPacket) bool {
+	if pkg.Qos < 2 {
+		return true
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.ids.inbound[pkg.MessageID] {
+		return false
+	}
+
+	s.ids.inbound[pkg.MessageID] = true
+	return true
+}
+
+// AcknowledgePublish sends PUBACK for QoS 1 and PUBREC for QoS 2 PUBLISH packets
+func (s *Session) AcknowledgePublish(pkg *packets.PublishPacket) error {
+	switch pkg.Qos {
+	case 1:
+		return s.SendPuback(pkg.MessageID)
+	case 2:
+		pRec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pRec.MessageID = pkg.MessageID
+		return s.Write(pRec)
+	}
+	return nil
+}
+
+// SendPuback ...
+func (s *Session) SendPuback(messageID uint16) error {
+	pAck := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pAck.MessageID = messageID
+	return s.Write(pAck)
+}
+
+// HandlePuback removes the message acknowledged by the peer from the in-flight table
+// and resumes sending queued messages
+func (s *Session) HandlePuback(pkg *packets.PubackPacket) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.ids.outbound, pkg.MessageID)
+	s.startWriting()
+}
+
+// HandlePubrec marks the QoS 2 message as received by the peer and sends PUBREL
+func (s *Session) HandlePubrec(pkg *packets.PubrecPacket) error {
+	s.l.Lock()
+	if m, exists := s.ids.outbound[pkg.MessageID]; exists {
+		m.released = true
+		m.sentAt = time.Now().UTC()
+	}
+	s.l.Unlock()
+
+	return s.sendPubrel(pkg.MessageID)
+}
+
+// HandlePubrel forgets the message ID of a QoS 2 message received from the peer and sends PUBCOMP
+func (s *Session) HandlePubrel(pkg *packets.PubrelPacket) error {
+	s.l.Lock()
+	delete(s.ids.inbound, pkg.MessageID)
+	s.l.Unlock()
+
+	pComp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pComp.MessageID = pkg.MessageID
+	return s.Write(pComp)
+}
+
+// HandlePubcomp removes the QoS 2 message completed by the peer from the in-flight table
+// and resumes sending queued messages
+func (s *Session) HandlePubcomp(pkg *packets.PubcompPacket) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.ids.outbound, pkg.MessageID)
+	s.startWriting()
 }
 
 // SendSuback ...
-func (s *Session) SendSuback(messageID uint16) error {
+func (s *Session) SendSuback(messageID uint16, returnCodes []byte) error {
 	sAck := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	sAck.MessageID = messageID
+	sAck.ReturnCodes = returnCodes
 	return s.Write(sAck)
 }
 
 // SendUnsuback ...
+// MQTT 5 clients get a single reason code. Use AcknowledgeUnsubscribe to send one for each topic filter.
 func (s *Session) SendUnsuback(messageID uint16) error {
 	sAck := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	sAck.MessageID = messageID
 	return s.Write(sAck)
 }
 
-func (s *Session) deadline() time.Time {
-	return time.Now().UTC().Add(s.idleTimeout)
+// AcknowledgeUnsubscribe sends UNSUBACK for the packet, with a success reason code for each topic filter
+// for MQTT 5 clients
+func (s *Session) AcknowledgeUnsubscribe(pkg *packets.UnsubscribePacket) error {
+	sAck := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	sAck.MessageID = pkg.MessageID
+	return s.Write(&unsubackV5{sAck, make([]byte, len(pkg.Topics))})
+}
+
+// Grant records the QoS granted for a topic filter and returns it.
+// Requested QoS levels above MaxQos are downgraded.
+func (s *Session) Grant(topic string, qos byte) byte {
+	if qos > MaxQos {
+		qos = MaxQos
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.grantedQos[topic] = qos
+	return qos
+}
+
+// Revoke removes the QoS granted for a topic filter
+func (s *Session) Revoke(topic string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.grantedQos, topic)
+}
+
+// detach removes the QoS 1 and QoS 2 message flows, the granted QoS levels and the messages
+// that have not been sent yet from the session and returns them
+func (s *Session) detach() (*packetIDState, map[string]byte, []queuedMessage) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	ids, grantedQos, queue := s.ids, s.grantedQos, s.queue
+	s.ids = newPacketIDState()
+	s.grantedQos = make(map[string]byte)
+	s.queue = []queuedMessage{}
+	return ids, grantedQos, queue
+}
+
+// restore takes over the state of a previous connection and returns the packets that need to be sent again:
+// unacknowledged PUBLISH packets with the DUP flag set and PUBREL for released QoS 2 messages.
+func (s *Session) restore(o *offlineSession) []packets.ControlPacket {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.ids = o.ids
+	s.grantedQos = o.grantedQos
+
+	pending := make([]packets.ControlPacket, 0, len(o.ids.outbound))
+	for _, m := range o.ids.outbound {
+		m.sentAt = time.Now().UTC()
+		pending = append(pending, m.retryPacket())
+	}
+	if len(pending) > 0 {
+		s.startRetrying()
+	}
+	return pending
+}
+
+// redeliver sends the packets returned by restore, followed by the messages queued while the client was offline
+func (s *Session) redeliver(pending []packets.ControlPacket, queue []queuedMessage) error {
+	for _, p := range pending {
+		if err := s.Write(p); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range queue {
+		if err := s.publish(m.topic, m.message, m.qos, false, m.props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) sendPubrel(messageID uint16) error {
+	pRel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pRel.MessageID = messageID
+	return s.Write(pRel)
+}
+
+// matchQos returns the highest QoS granted to a topic filter matching topic
+func matchQos(grantedQos map[string]byte, topic string) (qos byte) {
+	if len(grantedQos) == 0 {
+		return
+	}
+
+	topicParts := strings.Split(topic, "/")
+	for filter, q := range grantedQos {
+		if q > qos && TopicsMatch(topicParts, strings.Split(StripSharePrefix(filter), "/")) {
+			qos = q
+		}
+	}
+	return
+}
+
+// addInflight allocates a message ID for p and stores a copy in the in-flight table,
+// together with the properties it is sent with. The table holds at most maxInflight <= maxPacketIDs
+// messages, so a free ID exists. s.l must be held by the caller.
+func (s *Session) addInflight(p *packets.PublishPacket, props *Properties) {
+	ids := s.ids
+	for {
+		ids.nextID++
+		if ids.nextID == 0 {
+			continue
+		}
+		if _, taken := ids.outbound[ids.nextID]; !taken {
+			break
+		}
+	}
+
+	p.MessageID = ids.nextID
+	stored := *p
+
+	ids.outbound[ids.nextID] = &inflightMessage{pkg: &stored, props: props, sentAt: time.Now().UTC()}
+	s.startRetrying()
+}
+
+// startRetrying runs the redelivery loop unless it is already running. MQTT 5 only allows
+// redelivery when the client reconnects, so there is no loop for MQTT 5 sessions.
+// s.l must be held by the caller.
+func (s *Session) startRetrying() {
+	if s.retrying || s.closed || s.version == ProtocolVersion5 {
+		return
+	}
+
+	s.retrying = true
+	go s.retryLoop()
+}
+
+func (s *Session) retryLoop() {
+	ticker := time.NewTicker(s.retryInterval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.l.Lock()
+		if s.closed || len(s.ids.outbound) == 0 {
+			s.retrying = false
+			s.l.Unlock()
+			return
+		}
+
+		now := time.Now().UTC()
+		expired := []packets.ControlPacket{}
+
+		for _, m := range s.ids.outbound {
+			if now.Sub(m.sentAt) >= s.retryInterval {
+				m.sentAt = now
+				expired = append(expired, m.retryPacket())
+			}
+		}
+		s.l.Unlock()
+
+		for _, p := range expired {
+			if err := s.Write(p); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// retryPacket returns the packet to send when the peer has not responded in time:
+// PUBREL for released QoS 2 messages, otherwise the PUBLISH packet with the DUP flag set.
+func (m *inflightMessage) retryPacket() packets.ControlPacket {
+	if m.released {
+		pRel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pRel.MessageID = m.pkg.MessageID
+		return pRel
+	}
+
+	dup := *m.pkg
+	dup.Dup = true
+	if m.props != nil {
+		return &publishV5{&dup, m.props}
+	}
+	return &dup
+}
+
+func (s *Session) readDeadline() time.Time {
+	return time.Now().UTC().Add(s.readTimeout)
+}
+
+func (s *Session) writeDeadline() time.Time {
+	return time.Now().UTC().Add(s.writeTimeout)
 }
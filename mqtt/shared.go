@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+)
+
+// SharePrefix starts a shared subscription filter of the form $share/<group>/<filter>.
+// Each message matching the filter is delivered to only one subscriber of the group.
+const SharePrefix = "$share/"
+
+// ParseSharedFilter splits a shared subscription filter into the group name and the topic filter.
+// ok is false if filter is not a shared subscription or the group name is invalid.
+func ParseSharedFilter(filter string) (group, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, SharePrefix) {
+		return "", filter, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(filter, SharePrefix), "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || strings.ContainsAny(parts[0], singleLevelWildcard+multiLevelWildcard) {
+		return "", filter, false
+	}
+	return parts[0], parts[1], true
+}
+
+// StripSharePrefix returns the topic filter of a shared subscription or filter itself if it is not shared
+func StripSharePrefix(filter string) string {
+	_, topicFilter, _ := ParseSharedFilter(filter)
+	return topicFilter
+}
+
+// sharedGroup is subscribed to the topic filter in place of its members and
+// passes each message on to one of them in turn
+type sharedGroup struct {
+	l       sync.Mutex
+	members []Subscriber
+	next    int
+}
+
+// HandleMessage implements Subscriber
+func (g *sharedGroup) HandleMessage(topic string, message interface{}) error {
+	if s := g.pick(); s != nil {
+		return s.HandleMessage(topic, message)
+	}
+	return nil
+}
+
+// pick returns the next member in round robin order
+func (g *sharedGroup) pick() Subscriber {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	if len(g.members) == 0 {
+		return nil
+	}
+
+	if g.next >= len(g.members) {
+		g.next = 0
+	}
+
+	s := g.members[g.next]
+	g.next++
+	return s
+}
+
+func (g *sharedGroup) add(s Subscriber) {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	if indexOf(g.members, s) == -1 {
+		g.members = append(g.members, s)
+	}
+}
+
+// remove returns the number of remaining members
+func (g *sharedGroup) remove(s Subscriber) int {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	if i := indexOf(g.members, s); i != -1 {
+		g.members = append(g.members[:i], g.members[i+1:]...)
+	}
+	return len(g.members)
+}
+
+// subscribeShared adds s to the group of a shared subscription. b.l must be held by the caller.
+func (b *Broker) subscribeShared(filter, topicFilter string, s Subscriber) {
+	g, exists := b.shared[filter]
+	if !exists {
+		g = &sharedGroup{}
+		b.shared[filter] = g
+		b.subscribers.add(topicFilter, g)
+	}
+	g.add(s)
+}
+
+// unsubscribeShared removes s from the group of a shared subscription and removes
+// the group once it is empty. b.l must be held by the caller.
+func (b *Broker) unsubscribeShared(filter, topicFilter string, s Subscriber) {
+	g, exists := b.shared[filter]
+	if !exists {
+		return
+	}
+
+	if g.remove(s) == 0 {
+		delete(b.shared, filter)
+		b.subscribers.remove(topicFilter, g)
+	}
+}
+
+// leaveSharedGroups removes s from all groups. b.l must be held by the caller.
+func (b *Broker) leaveSharedGroups(s Subscriber) {
+	for filter := range b.shared {
+		_, topicFilter, _ := ParseSharedFilter(filter)
+		b.unsubscribeShared(filter, topicFilter, s)
+	}
+}
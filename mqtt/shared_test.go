@@ -0,0 +1,122 @@
+package mqtt_test
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Shared subscriptions", func() {
+
+	var broker *mqtt.Broker
+	var member1, member2, subscriber *testutils.PubSubRecorder
+	var filter = "$share/stations/matriarch/+/stations"
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			broker.Publish("matriarch/1.marsara/stations", i)
+		}
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false)
+		member1 = testutils.NewPubSubRecorder()
+		member2 = testutils.NewPubSubRecorder()
+		subscriber = testutils.NewPubSubRecorder()
+
+		broker.Subscribe(filter, member1)
+		broker.Subscribe(filter, member2)
+		broker.Subscribe("matriarch/+/stations", subscriber)
+	})
+	It("delivers each message to one member of the group", func() {
+		publish(4)
+
+		Expect(member1.Count()).To(Equal(2))
+		Expect(member2.Count()).To(Equal(2))
+		Expect(subscriber.Count()).To(Equal(4))
+
+		topic, _ := member1.First()
+		Expect(topic).To(Equal("matriarch/1.marsara/stations"))
+	})
+	It("delivers to the remaining members after one unsubscribes", func() {
+		broker.Unsubscribe(filter, member1)
+		publish(2)
+
+		Expect(member1.Count()).To(BeZero())
+		Expect(member2.Count()).To(Equal(2))
+	})
+	It("keeps groups with the same filter apart", func() {
+		other := testutils.NewPubSubRecorder()
+		broker.Subscribe("$share/other/matriarch/+/stations", other)
+		publish(2)
+
+		Expect(other.Count()).To(Equal(2))
+		Expect(member1.Count() + member2.Count()).To(Equal(2))
+	})
+	It("stops delivering once all members unsubscribed", func() {
+		broker.Unsubscribe(filter, member1)
+		broker.Unsubscribe(filter, member2)
+		publish(1)
+
+		Expect(member1.Count() + member2.Count()).To(BeZero())
+		Expect(subscriber.Count()).To(Equal(1))
+	})
+	Describe("subscribe packet", func() {
+		var brokerSession, subscriberSession *mqtt.Session
+		var events *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			brokerSession, subscriberSession = testutils.Pipe()
+			events = testutils.NewPubSubRecorder()
+			broker.Subscribe(mqtt.SubscribeEventTopic, events)
+
+			broker.PublishRetained("matriarch/1.marsara/stations", []byte("{}"))
+		})
+		AfterEach(func() {
+			subscriberSession.Close()
+		})
+		It("publishes the subscribe event without the share prefix and sends no retained messages", func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{filter, "$share//matriarch/#", "$share/stations"}
+			subPkg.Qoss = []byte{1, 1, 1}
+			subPkg.MessageID = 1
+
+			go broker.HandleSubscribePacket(subPkg, brokerSession, true)
+
+			p, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.SubackPacket).ReturnCodes).To(Equal([]byte{1, mqtt.SubackFailure, mqtt.SubackFailure}))
+
+			Eventually(events.Count).Should(Equal(1))
+			_, msg := events.First()
+			Expect(msg.(mqtt.SubscribeMessage).Topics).To(Equal([]string{"matriarch/+/stations"}))
+
+			brokerSession.Close()
+			_, err = subscriberSession.Read()
+			Expect(err).To(HaveOccurred())
+		})
+		It("delivers messages with the granted QoS", func() {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{filter}
+			subPkg.Qoss = []byte{1}
+			subPkg.MessageID = 1
+
+			go broker.HandleSubscribePacket(subPkg, brokerSession, false)
+
+			_, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(time.Millisecond * 10)
+
+			// member1, member2 and the session are served in turn
+			publish(3)
+
+			p, err := subscriberSession.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).Qos).To(Equal(byte(1)))
+		})
+	})
+})
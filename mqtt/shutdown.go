@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/superscale/spire/config"
+)
+
+// ErrServerClosed is returned by Run after Shutdown has been called
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+const defaultShutdownBatchSize = 100
+const defaultShutdownBatchInterval = time.Second
+
+// sessionGroup keeps track of the sessions of a server, so that they can be disconnected on shutdown
+// and connections can be limited
+type sessionGroup struct {
+	l          sync.Mutex
+	sessions   map[*Session]bool
+	perIP      map[string]int // remote IP -> number of sessions
+	handshakes int
+	handlers   sync.WaitGroup
+	closed     bool
+
+	limits  Limits
+	limiter *rateLimiter
+
+	batchSize     int
+	batchInterval time.Duration
+}
+
+func newSessionGroup() *sessionGroup {
+	batchSize := config.Config.ShutdownBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultShutdownBatchSize
+	}
+
+	batchInterval := config.Config.ShutdownBatchInterval
+	if batchInterval <= 0 {
+		batchInterval = defaultShutdownBatchInterval
+	}
+
+	return &sessionGroup{
+		sessions:      make(map[*Session]bool),
+		perIP:         make(map[string]int),
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+	}
+}
+
+// serve runs sessHandler for the connection and returns when it is done.
+// The connection is closed right away if the group is shutting down and refused if it exceeds the limits.
+func (g *sessionGroup) serve(conn net.Conn, sessHandler SessionHandler) {
+	// may wait for the PROXY protocol header
+	ip := remoteIP(conn)
+
+	g.l.Lock()
+	if g.closed {
+		g.l.Unlock()
+		conn.Close()
+		return
+	}
+
+	if reason := g.admit(ip); len(reason) > 0 {
+		g.handlers.Add(1)
+		g.l.Unlock()
+
+		refuse(conn, reason)
+		g.handlers.Done()
+		return
+	}
+
+	session := NewSession(conn, config.Config.IdleConnectionTimeout)
+	session.onHandshake = g.endHandshake
+	g.sessions[session] = true
+	g.perIP[ip]++
+	g.handshakes++
+	g.handlers.Add(1)
+	g.l.Unlock()
+
+	defer func() {
+		session.endHandshake()
+
+		g.l.Lock()
+		delete(g.sessions, session)
+		if g.perIP[ip]--; g.perIP[ip] == 0 {
+			delete(g.perIP, ip)
+		}
+		g.l.Unlock()
+
+		g.handlers.Done()
+	}()
+
+	if err := session.handshakeTLS(); err != nil {
+		session.Close()
+		return
+	}
+	handleSession(session, sessHandler)
+}
+
+func (g *sessionGroup) isClosed() bool {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	return g.closed
+}
+
+// close makes the group refuse new connections and returns the current sessions
+func (g *sessionGroup) close() []*Session {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	g.closed = true
+	sessions := make([]*Session, 0, len(g.sessions))
+	for s := range g.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// disconnect sends DISCONNECT to the sessions in batches of batchSize, one batch every batchInterval,
+// and waits for the handlers of the group to return. Connections that are still open when ctx is done
+// are closed without sending DISCONNECT.
+func (g *sessionGroup) disconnect(ctx context.Context, sessions []*Session) error {
+	for i := 0; i < len(sessions); i += g.batchSize {
+		if i > 0 {
+			select {
+			case <-time.After(g.batchInterval):
+			case <-ctx.Done():
+				g.abort()
+				return ctx.Err()
+			}
+		}
+
+		end := i + g.batchSize
+		if end > len(sessions) {
+			end = len(sessions)
+		}
+
+		for _, s := range sessions[i:end] {
+			go s.Disconnect()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		g.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.abort()
+		return ctx.Err()
+	}
+}
+
+// abort closes the connections of all remaining sessions
+func (g *sessionGroup) abort() {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	for s := range g.sessions {
+		s.abort()
+	}
+}
@@ -0,0 +1,99 @@
+package mqtt_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+)
+
+var _ = Describe("Shutdown", func() {
+
+	var server *mqtt.Server
+	var handler mqtt.SessionHandler
+	var runErr chan error
+
+	connect := func(clientID string) *mqtt.Session {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		client := mqtt.NewSession(conn, time.Second)
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = clientID
+		conPkg.Keepalive = 30
+		Expect(client.Write(conPkg)).NotTo(HaveOccurred())
+
+		p, err := client.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(BeAssignableToTypeOf(&packets.ConnackPacket{}))
+		return client
+	}
+
+	BeforeEach(func() {
+		config.Config.ShutdownBatchSize = 2
+		config.Config.ShutdownBatchInterval = time.Millisecond * 50
+		handler = mqtt.NewBroker(false).HandleConnection
+	})
+	JustBeforeEach(func() {
+		server = mqtt.NewServer("127.0.0.1:0", handler)
+		runErr = make(chan error, 1)
+		go func(server *mqtt.Server, runErr chan error) {
+			runErr <- server.Run()
+		}(server, runErr)
+		Eventually(server.Addr).ShouldNot(BeNil())
+	})
+	AfterEach(func() {
+		config.Config.ShutdownBatchSize = 0
+		config.Config.ShutdownBatchInterval = 0
+	})
+	It("sends DISCONNECT to clients in batches and stops accepting connections", func() {
+		clients := []*mqtt.Session{connect("matriarch-1"), connect("matriarch-2"), connect("matriarch-3")}
+		addr := server.Addr().String()
+
+		start := time.Now()
+		Expect(server.Shutdown(context.Background())).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Millisecond*50))
+
+		for _, client := range clients {
+			p, err := client.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(BeAssignableToTypeOf(&packets.DisconnectPacket{}))
+			client.Close()
+		}
+
+		Eventually(runErr).Should(Receive(Equal(mqtt.ErrServerClosed)))
+
+		_, err := net.Dial("tcp", addr)
+		Expect(err).To(HaveOccurred())
+	})
+	Context("with handlers that do not return", func() {
+		var block chan struct{}
+
+		BeforeEach(func() {
+			block = make(chan struct{})
+			handler = func(*mqtt.Session) {
+				<-block
+			}
+		})
+		AfterEach(func() {
+			close(block)
+		})
+		It("gives up when the context is done", func() {
+			conn, err := net.Dial("tcp", server.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+			defer cancel()
+
+			Eventually(server.Addr).ShouldNot(BeNil())
+			time.Sleep(time.Millisecond * 10)
+			Expect(server.Shutdown(ctx)).To(Equal(context.DeadlineExceeded))
+		})
+	})
+})
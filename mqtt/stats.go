@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/superscale/spire/monitoring"
+)
+
+// StatsTopicPrefix is the prefix of the topics the broker statistics are published on
+const StatsTopicPrefix = InternalTopicPrefix + "/spire/stats"
+
+const defaultStatsInterval = 10 * time.Second
+
+// StatsPublisher periodically publishes the counters of the monitoring package as retained messages
+// under StatsTopicPrefix, e.g. $SYS/spire/stats/clients/devices.
+type StatsPublisher struct {
+	broker   *Broker
+	interval time.Duration
+	stop     chan struct{}
+
+	last     monitoring.Stats
+	lastTime time.Time
+}
+
+// NewStatsPublisher returns a StatsPublisher that publishes every interval. It falls back to 10 seconds
+// if interval is not positive.
+func NewStatsPublisher(broker *Broker, interval time.Duration) *StatsPublisher {
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+
+	return &StatsPublisher{
+		broker:   broker,
+		interval: interval,
+		stop:     make(chan struct{}),
+		lastTime: time.Now(),
+	}
+}
+
+// Run publishes the statistics until Stop is called
+func (p *StatsPublisher) Run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.publish(monitoring.Snapshot(), time.Now())
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run
+func (p *StatsPublisher) Stop() {
+	close(p.stop)
+}
+
+// publish sends the current values. The message rates are averaged over the time since the last call.
+func (p *StatsPublisher) publish(stats monitoring.Stats, now time.Time) {
+	elapsed := now.Sub(p.lastTime).Seconds()
+
+	var inRate, outRate float64
+	if elapsed > 0 {
+		inRate = float64(stats.MessagesIn-p.last.MessagesIn) / elapsed
+		outRate = float64(stats.MessagesOut-p.last.MessagesOut) / elapsed
+	}
+
+	values := map[string]interface{}{
+		"clients/devices":         stats.DeviceClients,
+		"clients/control":         stats.ControlClients,
+		"messages/in_per_second":  inRate,
+		"messages/out_per_second": outRate,
+		"subscriptions":           stats.Subscriptions,
+		"errors/handlers":         stats.HandlerErrors,
+		"uptime":                  int64(stats.Uptime.Seconds()),
+	}
+
+	for path, value := range values {
+		p.broker.PublishRetained(StatsTopicPrefix+"/"+path, value)
+	}
+
+	p.last = stats
+	p.lastTime = now
+}
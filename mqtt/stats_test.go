@@ -0,0 +1,82 @@
+package mqtt_test
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/monitoring"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Stats", func() {
+
+	var broker *mqtt.Broker
+	var recorder *testutils.PubSubRecorder
+	var publisher *mqtt.StatsPublisher
+
+	values := func() map[string]interface{} {
+		res := make(map[string]interface{})
+		for i := 0; i < recorder.Count(); i++ {
+			topic, value := recorder.Get(i)
+			res[topic] = value
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false)
+		recorder = testutils.NewPubSubRecorder()
+		broker.Subscribe(mqtt.StatsTopicPrefix+"/#", recorder)
+
+		publisher = mqtt.NewStatsPublisher(broker, time.Millisecond*10)
+		go publisher.Run()
+	})
+	AfterEach(func() {
+		publisher.Stop()
+	})
+	It("publishes the counters of the monitoring package", func() {
+		Eventually(recorder.Count).Should(BeNumerically(">=", 7))
+		v := values()
+		Expect(v["$SYS/spire/stats/clients/devices"]).To(BeAssignableToTypeOf(int64(0)))
+		Expect(v["$SYS/spire/stats/clients/control"]).To(BeAssignableToTypeOf(int64(0)))
+		Expect(v["$SYS/spire/stats/subscriptions"]).To(BeNumerically(">=", 1))
+		Expect(v["$SYS/spire/stats/errors/handlers"]).To(BeAssignableToTypeOf(int64(0)))
+		Expect(v["$SYS/spire/stats/messages/in_per_second"]).To(BeAssignableToTypeOf(float64(0)))
+		Expect(v["$SYS/spire/stats/messages/out_per_second"]).To(BeAssignableToTypeOf(float64(0)))
+		Expect(v).To(HaveKey("$SYS/spire/stats/uptime"))
+	})
+	It("retains the values for clients subscribing later", func() {
+		Eventually(recorder.Count).Should(BeNumerically(">=", 7))
+
+		brokerSession, subscriberSession := testutils.Pipe()
+		defer subscriberSession.Close()
+
+		subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subPkg.Topics = []string{mqtt.StatsTopicPrefix + "/uptime"}
+		subPkg.Qoss = []byte{0}
+		subPkg.MessageID = 1
+		go broker.HandleSubscribePacket(subPkg, brokerSession, false)
+
+		_, err := subscriberSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		p, err := subscriberSession.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.(*packets.PublishPacket).TopicName).To(Equal("$SYS/spire/stats/uptime"))
+		Expect(p.(*packets.PublishPacket).Retain).To(BeTrue())
+	})
+	It("counts subscriptions", func() {
+		before := monitoring.Snapshot().Subscriptions
+
+		s := testutils.NewPubSubRecorder()
+		broker.Subscribe("matriarch/+/stations", s)
+		broker.Subscribe("matriarch/+/stations", s)
+		Expect(monitoring.Snapshot().Subscriptions).To(Equal(before + 1))
+
+		broker.Unsubscribe("matriarch/+/stations", s)
+		Expect(monitoring.Snapshot().Subscriptions).To(Equal(before))
+	})
+})
@@ -0,0 +1,201 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCertReloadInterval = time.Minute
+
+// TLSOptions configures a TLS listener
+type TLSOptions struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites []string
+	// ClientCAFile enables client certificate verification. Clients must present
+	// a certificate signed by one of the CAs in the file.
+	ClientCAFile string
+	// ReloadInterval is how often the certificate and key file are checked for changes. defaults to a minute
+	ReloadInterval time.Duration
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig creates a server TLS config from opts. The certificate is reloaded in the background
+// when the certificate or key file has changed.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if len(opts.CertFile) == 0 || len(opts.KeyFile) == 0 {
+		return nil, errors.New("TLS requires a certificate and a key file")
+	}
+
+	reloader, err := newCertReloader(opts.CertFile, opts.KeyFile, opts.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if len(opts.MinVersion) > 0 {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", opts.MinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	if tlsConfig.CipherSuites, err = cipherSuites(opts.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	if len(opts.ClientCAFile) > 0 {
+		if tlsConfig.ClientCAs, err = loadCertPool(opts.ClientCAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ids := map[string]uint16{}
+	for _, c := range tls.CipherSuites() {
+		ids[c.Name] = c.ID
+	}
+
+	res := []uint16{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// certReloader serves the certificate loaded last. Handshakes only read the cached certificate;
+// the files are checked by a background loop.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert    atomic.Value // *tls.Certificate
+	modTime time.Time    // only used by reloadLoop after the first load
+	lastErr string
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modTime, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.load(modTime); err != nil {
+		return nil, err
+	}
+
+	go r.reloadLoop(interval)
+	return r, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// reloadLoop loads the certificate when the files have changed. The previous certificate is kept
+// if that fails. Errors are logged once until they change.
+func (r *certReloader) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTime, err := r.lastModified()
+		if err == nil && modTime.After(r.modTime) {
+			err = r.load(modTime)
+		}
+
+		if err == nil {
+			r.lastErr = ""
+		} else if err.Error() != r.lastErr {
+			log.Printf("error while reloading TLS certificate %s: %v", r.certFile, err)
+			r.lastErr = err.Error()
+		}
+	}
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+// lastModified returns the later modification time of the certificate and key file
+func (r *certReloader) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
@@ -0,0 +1,149 @@
+package mqtt_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/mqtt"
+)
+
+// writeCertificate writes a self-signed certificate with the given serial number and its key to dir
+func writeCertificate(dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "spire"},
+		DNSNames:     []string{"spire"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).NotTo(HaveOccurred())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).NotTo(HaveOccurred())
+	return certFile, keyFile
+}
+
+// handshake returns the certificate the server presents to a client
+func handshake(tlsConfig *tls.Config) *x509.Certificate {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go tls.Server(a, tlsConfig).Handshake()
+
+	client := tls.Client(b, &tls.Config{InsecureSkipVerify: true})
+	Expect(client.Handshake()).NotTo(HaveOccurred())
+	return client.ConnectionState().PeerCertificates[0]
+}
+
+var _ = Describe("TLS", func() {
+
+	var dir, certFile, keyFile string
+	var opts mqtt.TLSOptions
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "spire-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		certFile, keyFile = writeCertificate(dir, 1)
+		opts = mqtt.TLSOptions{CertFile: certFile, KeyFile: keyFile}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	It("presents the configured certificate", func() {
+		tlsConfig, err := mqtt.NewTLSConfig(opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+
+		Expect(handshake(tlsConfig).SerialNumber.Int64()).To(Equal(int64(1)))
+	})
+	It("reloads the certificate when the files change", func() {
+		opts.ReloadInterval = time.Millisecond * 10
+		tlsConfig, err := mqtt.NewTLSConfig(opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		writeCertificate(dir, 2)
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(certFile, later, later)).NotTo(HaveOccurred())
+
+		Eventually(func() int64 {
+			return handshake(tlsConfig).SerialNumber.Int64()
+		}).Should(Equal(int64(2)))
+	})
+	It("sets the minimum version and cipher suites", func() {
+		opts.MinVersion = "1.3"
+		opts.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+
+		tlsConfig, err := mqtt.NewTLSConfig(opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+		Expect(tlsConfig.CipherSuites).To(Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}))
+	})
+	It("rejects unknown versions and cipher suites", func() {
+		opts.MinVersion = "2.0"
+		_, err := mqtt.NewTLSConfig(opts)
+		Expect(err).To(HaveOccurred())
+
+		opts.MinVersion = ""
+		opts.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+		_, err = mqtt.NewTLSConfig(opts)
+		Expect(err).To(HaveOccurred())
+	})
+	It("closes connections without a client certificate before they are handled", func() {
+		opts.ClientCAFile = certFile
+		tlsConfig, err := mqtt.NewTLSConfig(opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		handled := make(chan *mqtt.Session, 1)
+		server := mqtt.NewTLSServer("127.0.0.1:0", tlsConfig, func(session *mqtt.Session) {
+			handled <- session
+		})
+		go server.Run()
+		defer server.Shutdown(context.Background())
+		Eventually(server.Addr).ShouldNot(BeNil())
+
+		dialer := &net.Dialer{Timeout: time.Second}
+		conn, err := tls.DialWithDialer(dialer, "tcp", server.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			// with TLS 1.3 the client learns about the failed handshake on its first read
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		Expect(err).To(HaveOccurred())
+		Consistently(handled, "20ms").ShouldNot(Receive())
+	})
+	It("fails without a key file", func() {
+		opts.KeyFile = ""
+		_, err := mqtt.NewTLSConfig(opts)
+		Expect(err).To(HaveOccurred())
+	})
+})
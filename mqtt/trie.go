@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/superscale/spire/monitoring"
+)
+
+// topicTrie stores subscribers by topic filter, one node per topic level.
+// Matching a topic visits only the nodes for its levels and the wildcards next to them,
+// independent of the total number of subscriptions.
+type topicTrie struct {
+	root    *trieNode
+	filters map[Subscriber]map[string]bool // subscriber -> filters it is subscribed to
+}
+
+type trieNode struct {
+	children    map[string]*trieNode
+	subscribers []Subscriber
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{
+		root:    newTrieNode(),
+		filters: make(map[Subscriber]map[string]bool),
+	}
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[string]*trieNode)}
+}
+
+// add subscribes s to filter. It does nothing if s is already subscribed to filter.
+func (t *topicTrie) add(filter string, s Subscriber) {
+	if t.filters[s][filter] {
+		return
+	}
+
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, exists := node.children[level]
+		if !exists {
+			child = newTrieNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers = append(node.subscribers, s)
+
+	if _, exists := t.filters[s]; !exists {
+		t.filters[s] = make(map[string]bool)
+	}
+	t.filters[s][filter] = true
+	monitoring.AddSubscription()
+}
+
+// remove unsubscribes s from filter and prunes nodes that are no longer needed
+func (t *topicTrie) remove(filter string, s Subscriber) {
+	if !t.filters[s][filter] {
+		return
+	}
+
+	levels := strings.Split(filter, "/")
+	path := make([]*trieNode, len(levels)+1)
+	path[0] = t.root
+
+	for i, level := range levels {
+		path[i+1] = path[i].children[level]
+	}
+
+	node := path[len(levels)]
+	if i := indexOf(node.subscribers, s); i >= 0 {
+		// from https://github.com/golang/go/wiki/SliceTricks
+		copy(node.subscribers[i:], node.subscribers[i+1:])
+		node.subscribers[len(node.subscribers)-1] = nil
+		node.subscribers = node.subscribers[:len(node.subscribers)-1]
+	}
+
+	for i := len(levels); i > 0; i-- {
+		n := path[i]
+		if len(n.subscribers) > 0 || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+
+	delete(t.filters[s], filter)
+	if len(t.filters[s]) == 0 {
+		delete(t.filters, s)
+	}
+	monitoring.RemoveSubscription()
+}
+
+// removeAll unsubscribes s from all filters
+func (t *topicTrie) removeAll(s Subscriber) {
+	for filter := range t.filters[s] {
+		t.remove(filter, s)
+	}
+}
+
+// replace substitutes new for old in all subscriptions of old
+func (t *topicTrie) replace(old, new Subscriber) {
+	for filter := range t.filters[old] {
+		t.remove(filter, old)
+		t.add(filter, new)
+	}
+}
+
+// match returns all subscribers with a filter matching topic. Subscribers with several
+// matching filters are returned only once. Assumes that topic does not contain wildcards.
+func (t *topicTrie) match(topic string) []Subscriber {
+	res := []Subscriber{}
+	seen := make(map[Subscriber]bool)
+
+	collect := func(subs []Subscriber) {
+		for _, s := range subs {
+			if !seen[s] {
+				seen[s] = true
+				res = append(res, s)
+			}
+		}
+	}
+
+	var walk func(node *trieNode, levels []string)
+	walk = func(node *trieNode, levels []string) {
+		// a multi-level wildcard also matches the parent level
+		if n, exists := node.children[multiLevelWildcard]; exists {
+			collect(n.subscribers)
+		}
+
+		if len(levels) == 0 {
+			collect(node.subscribers)
+			return
+		}
+
+		if n, exists := node.children[levels[0]]; exists {
+			walk(n, levels[1:])
+		}
+		if n, exists := node.children[singleLevelWildcard]; exists {
+			walk(n, levels[1:])
+		}
+	}
+
+	walk(t.root, strings.Split(topic, "/"))
+	return res
+}
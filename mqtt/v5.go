@@ -0,0 +1,516 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ProtocolVersion5 is the protocol level MQTT 5.0 clients send in CONNECT.
+// Sessions of clients with a lower level use the 3.1.1 codec of the paho packets package.
+const ProtocolVersion5 byte = 5
+
+// reason codes of MQTT 5.0 that have no equivalent in 3.1.1
+const (
+	reasonUnsupportedProtoVers = 0x84
+	reasonClientIDNotValid     = 0x85
+	reasonBadUsernamePassword  = 0x86
+	reasonNotAuthorized        = 0x87
+	reasonServerUnavailable    = 0x88
+	reasonServerShuttingDown   = 0x8B
+	reasonSessionTakenOver     = 0x8E
+	reasonQuotaExceeded        = 0x97
+)
+
+const maxVarint = 268435455
+
+var errMalformedPacket = errors.New("malformed MQTT 5 packet")
+
+// connackReasonCodes maps CONNACK return codes of 3.1.1 to MQTT 5 reason codes
+var connackReasonCodes = map[byte]byte{
+	packets.Accepted:                        0x00,
+	packets.ErrRefusedBadProtocolVersion:    reasonUnsupportedProtoVers,
+	packets.ErrRefusedIDRejected:            reasonClientIDNotValid,
+	packets.ErrRefusedServerUnavailable:     reasonServerUnavailable,
+	packets.ErrRefusedBadUsernameOrPassword: reasonBadUsernamePassword,
+	packets.ErrRefusedNotAuthorised:         reasonNotAuthorized,
+}
+
+// publishV5 is a PUBLISH packet with the properties it is sent with to MQTT 5 sessions.
+// Sessions of 3.1.1 clients send the embedded packet without them.
+type publishV5 struct {
+	*packets.PublishPacket
+	props *Properties
+}
+
+// disconnectV5 is a DISCONNECT packet with the reason code it is sent with to MQTT 5 sessions
+type disconnectV5 struct {
+	*packets.DisconnectPacket
+	reason byte
+}
+
+// unsubackV5 is an UNSUBACK packet with one reason code per topic filter of the UNSUBSCRIBE packet
+type unsubackV5 struct {
+	*packets.UnsubackPacket
+	reasonCodes []byte
+}
+
+// ReadPacketV5 reads an MQTT 5 packet. The packet is returned as the equivalent packet of the paho packets
+// package, with its properties returned separately. Reason codes of acknowledgements are dropped,
+// except for SUBACK return codes. The will properties of CONNECT packets are dropped as well.
+func ReadPacketV5(r io.Reader) (packets.ControlPacket, *Properties, error) {
+	header, body, err := readRawPacket(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkg, props, _, err := decodePacketV5(header, body)
+	return pkg, props, err
+}
+
+// WritePacketV5 writes pkg and props in the MQTT 5 format. CONNACK return codes of 3.1.1 are
+// converted to the corresponding reason codes and DISCONNECT is sent with "normal disconnection".
+func WritePacketV5(w io.Writer, pkg packets.ControlPacket, props *Properties) error {
+	buf, err := encodePacketV5(pkg, props)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// readRawPacket returns the first byte of the fixed header and the variable header and payload of the next packet
+func readRawPacket(r io.Reader) (header byte, body []byte, err error) {
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	header = b[0]
+
+	var length, multiplier uint32 = 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errMalformedPacket
+		}
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+
+		length += uint32(b[0]&0x7F) * multiplier
+		multiplier *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// connectProtocolLevel returns the protocol level of a CONNECT packet body or 0 if it is too short
+func connectProtocolLevel(body []byte) byte {
+	if len(body) < 2 {
+		return 0
+	}
+
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n+1 {
+		return 0
+	}
+	return body[2+n]
+}
+
+// decodePacketV5 returns the packet, its properties and, for CONNECT packets with a will, the will properties
+func decodePacketV5(header byte, body []byte) (pkg packets.ControlPacket, props, willProps *Properties, err error) {
+	d := &decoder{buf: body}
+	props = &Properties{}
+
+	pkg, err = packets.NewControlPacketWithHeader(packets.FixedHeader{
+		MessageType:     header >> 4,
+		Dup:             header&0x08 > 0,
+		Qos:             (header >> 1) & 0x03,
+		Retain:          header&0x01 > 0,
+		RemainingLength: len(body),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	switch p := pkg.(type) {
+	case *packets.ConnectPacket:
+		p.ProtocolName = d.readString()
+		p.ProtocolVersion = d.readByte()
+		flags := d.readByte()
+		p.ReservedBit = flags & 0x01
+		p.CleanSession = flags&0x02 > 0
+		p.WillFlag = flags&0x04 > 0
+		p.WillQos = (flags >> 3) & 0x03
+		p.WillRetain = flags&0x20 > 0
+		p.PasswordFlag = flags&0x40 > 0
+		p.UsernameFlag = flags&0x80 > 0
+		p.Keepalive = d.readUint16()
+		props.decode(d)
+		p.ClientIdentifier = d.readString()
+
+		if p.WillFlag {
+			willProps = &Properties{}
+			willProps.decode(d)
+			p.WillTopic = d.readString()
+			p.WillMessage = d.readBinary()
+		}
+		if p.UsernameFlag {
+			p.Username = d.readString()
+		}
+		if p.PasswordFlag {
+			p.Password = d.readBinary()
+		}
+	case *packets.ConnackPacket:
+		p.SessionPresent = d.readByte()&0x01 > 0
+		p.ReturnCode = d.readByte()
+		props.decode(d)
+	case *packets.PublishPacket:
+		if p.Qos > 2 {
+			return nil, nil, nil, errMalformedPacket
+		}
+		p.TopicName = d.readString()
+		if p.Qos > 0 {
+			p.MessageID = d.readUint16()
+		}
+		props.decode(d)
+		p.Payload = d.rest()
+	case *packets.PubackPacket:
+		p.MessageID = d.readAck(props)
+	case *packets.PubrecPacket:
+		p.MessageID = d.readAck(props)
+	case *packets.PubrelPacket:
+		p.MessageID = d.readAck(props)
+	case *packets.PubcompPacket:
+		p.MessageID = d.readAck(props)
+	case *packets.SubscribePacket:
+		p.MessageID = d.readUint16()
+		props.decode(d)
+		for len(d.buf) > 0 && d.err == nil {
+			p.Topics = append(p.Topics, d.readString())
+			// retain handling, retain as published and no local are not supported
+			p.Qoss = append(p.Qoss, d.readByte()&0x03)
+		}
+	case *packets.SubackPacket:
+		p.MessageID = d.readUint16()
+		props.decode(d)
+		p.ReturnCodes = d.rest()
+	case *packets.UnsubscribePacket:
+		p.MessageID = d.readUint16()
+		props.decode(d)
+		for len(d.buf) > 0 && d.err == nil {
+			p.Topics = append(p.Topics, d.readString())
+		}
+	case *packets.UnsubackPacket:
+		p.MessageID = d.readUint16()
+		props.decode(d)
+		d.rest()
+	case *packets.DisconnectPacket:
+		if len(d.buf) > 0 {
+			d.readByte()
+		}
+		if len(d.buf) > 0 {
+			props.decode(d)
+		}
+	case *packets.PingreqPacket, *packets.PingrespPacket:
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported MQTT 5 packet type %d", header>>4)
+	}
+
+	if d.err != nil {
+		return nil, nil, nil, d.err
+	}
+	if len(d.buf) > 0 {
+		return nil, nil, nil, errMalformedPacket
+	}
+	return pkg, props, willProps, nil
+}
+
+func encodePacketV5(pkg packets.ControlPacket, props *Properties) ([]byte, error) {
+	var e encoder
+	var header byte
+
+	switch p := pkg.(type) {
+	case *packets.ConnectPacket:
+		header = packets.Connect << 4
+		e.writeString("MQTT")
+		e.WriteByte(ProtocolVersion5)
+
+		var flags byte
+		if p.CleanSession {
+			flags |= 0x02
+		}
+		if p.WillFlag {
+			flags |= 0x04 | p.WillQos<<3
+			if p.WillRetain {
+				flags |= 0x20
+			}
+		}
+		if p.PasswordFlag {
+			flags |= 0x40
+		}
+		if p.UsernameFlag {
+			flags |= 0x80
+		}
+		e.WriteByte(flags)
+		e.writeUint16(p.Keepalive)
+		props.encode(&e)
+		e.writeString(p.ClientIdentifier)
+
+		if p.WillFlag {
+			(*Properties)(nil).encode(&e)
+			e.writeString(p.WillTopic)
+			e.writeBinary(p.WillMessage)
+		}
+		if p.UsernameFlag {
+			e.writeString(p.Username)
+		}
+		if p.PasswordFlag {
+			e.writeBinary(p.Password)
+		}
+	case *packets.ConnackPacket:
+		header = packets.Connack << 4
+		if p.SessionPresent {
+			e.WriteByte(0x01)
+		} else {
+			e.WriteByte(0x00)
+		}
+
+		code, ok := connackReasonCodes[p.ReturnCode]
+		if !ok {
+			code = p.ReturnCode
+		}
+		e.WriteByte(code)
+		props.encode(&e)
+	case *publishV5:
+		return encodePacketV5(p.PublishPacket, p.props)
+	case *packets.PublishPacket:
+		header = packets.Publish<<4 | p.Qos<<1
+		if p.Dup {
+			header |= 0x08
+		}
+		if p.Retain {
+			header |= 0x01
+		}
+
+		e.writeString(p.TopicName)
+		if p.Qos > 0 {
+			e.writeUint16(p.MessageID)
+		}
+		props.encode(&e)
+		e.Write(p.Payload)
+	case *packets.PubackPacket:
+		header = packets.Puback << 4
+		e.writeUint16(p.MessageID)
+	case *packets.PubrecPacket:
+		header = packets.Pubrec << 4
+		e.writeUint16(p.MessageID)
+	case *packets.PubrelPacket:
+		header = packets.Pubrel<<4 | 0x02
+		e.writeUint16(p.MessageID)
+	case *packets.PubcompPacket:
+		header = packets.Pubcomp << 4
+		e.writeUint16(p.MessageID)
+	case *packets.SubscribePacket:
+		header = packets.Subscribe<<4 | 0x02
+		e.writeUint16(p.MessageID)
+		props.encode(&e)
+		for i, topic := range p.Topics {
+			e.writeString(topic)
+			var qos byte
+			if i < len(p.Qoss) {
+				qos = p.Qoss[i]
+			}
+			e.WriteByte(qos)
+		}
+	case *packets.SubackPacket:
+		header = packets.Suback << 4
+		e.writeUint16(p.MessageID)
+		props.encode(&e)
+		e.Write(p.ReturnCodes)
+	case *packets.UnsubscribePacket:
+		header = packets.Unsubscribe<<4 | 0x02
+		e.writeUint16(p.MessageID)
+		props.encode(&e)
+		for _, topic := range p.Topics {
+			e.writeString(topic)
+		}
+	case *unsubackV5:
+		header = packets.Unsuback << 4
+		e.writeUint16(p.MessageID)
+		props.encode(&e)
+		e.Write(p.reasonCodes)
+	case *packets.UnsubackPacket:
+		return encodePacketV5(&unsubackV5{p, []byte{0x00}}, props)
+	case *packets.PingreqPacket:
+		header = packets.Pingreq << 4
+	case *packets.PingrespPacket:
+		header = packets.Pingresp << 4
+	case *disconnectV5:
+		header = packets.Disconnect << 4
+		e.WriteByte(p.reason)
+		props.encode(&e)
+	case *packets.DisconnectPacket:
+		return encodePacketV5(&disconnectV5{p, 0x00}, props)
+	default:
+		return nil, fmt.Errorf("cannot encode %s as MQTT 5 packet", pkg.String())
+	}
+
+	if e.Len() > maxVarint {
+		return nil, errors.New("MQTT 5 packet too large")
+	}
+
+	var out encoder
+	out.WriteByte(header)
+	out.writeVarint(uint32(e.Len()))
+	out.Write(e.Bytes())
+	return out.Bytes(), nil
+}
+
+// decoder reads the fields of a packet body. The first error is kept and makes all further reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errMalformedPacket
+	}
+	d.buf = nil
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.fail()
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) readByte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) readUint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) readUint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) readVarint() uint32 {
+	var v, multiplier uint32 = 0, 1
+	for i := 0; i < 4; i++ {
+		b := d.readByte()
+		if d.err != nil {
+			return 0
+		}
+
+		v += uint32(b&0x7F) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+
+	d.fail()
+	return 0
+}
+
+func (d *decoder) readBinary() []byte {
+	n := d.readUint16()
+	if d.err != nil {
+		return nil
+	}
+
+	b := d.take(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBinary())
+}
+
+// rest returns the remaining bytes of the body
+func (d *decoder) rest() []byte {
+	b := append([]byte{}, d.buf...)
+	d.buf = nil
+	return b
+}
+
+// readAck reads the message ID and the optional reason code and properties of PUBACK, PUBREC, PUBREL and PUBCOMP
+func (d *decoder) readAck(props *Properties) uint16 {
+	id := d.readUint16()
+	if len(d.buf) > 0 {
+		d.readByte()
+	}
+	if len(d.buf) > 0 {
+		props.decode(d)
+	}
+	return id
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) writeUint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) writeVarint(v uint32) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		e.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (e *encoder) writeBinary(b []byte) {
+	e.writeUint16(uint16(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeBinary([]byte(s))
+}
@@ -0,0 +1,310 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("MQTT 5", func() {
+
+	Describe("codec", func() {
+		It("reads the packets it writes", func() {
+			pkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pkg.TopicName = "pylon/1.marsara/rpc"
+			pkg.Payload = []byte(`{"method":"reboot"}`)
+			pkg.Qos = 1
+			pkg.MessageID = 42
+
+			props := &mqtt.Properties{
+				ContentType:     "application/json",
+				ResponseTopic:   "matriarch/1.marsara/rpc/reply",
+				CorrelationData: []byte("abc"),
+				MessageExpiry:   mqtt.Uint32(60),
+				User:            []mqtt.UserProperty{{Key: "firmware", Value: "2.1"}, {Key: "firmware", Value: "2.2"}},
+			}
+
+			buf := &bytes.Buffer{}
+			Expect(mqtt.WritePacketV5(buf, pkg, props)).To(Succeed())
+
+			p, readProps, err := mqtt.ReadPacketV5(buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			pubPkg := p.(*packets.PublishPacket)
+			Expect(pubPkg.TopicName).To(Equal(pkg.TopicName))
+			Expect(pubPkg.Payload).To(Equal(pkg.Payload))
+			Expect(pubPkg.Qos).To(BeEquivalentTo(1))
+			Expect(pubPkg.MessageID).To(BeEquivalentTo(42))
+			Expect(readProps).To(Equal(props))
+		})
+		It("refuses unknown properties", func() {
+			buf := bytes.NewBuffer([]byte{packets.Puback << 4, 5, 0, 1, 0, 2, 0x7F})
+
+			_, _, err := mqtt.ReadPacketV5(buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("broker", func() {
+		var broker *mqtt.Broker
+
+		BeforeEach(func() {
+			broker = mqtt.NewBroker(false)
+		})
+
+		// connectWithProps connects an MQTT 5 client to the broker and returns its end of the connection and CONNACK
+		connectWithProps := func(clientID string, cleanStart bool, props *mqtt.Properties) (net.Conn, *packets.ConnackPacket) {
+			server, client := net.Pipe()
+			go broker.HandleConnection(mqtt.NewSession(server, time.Second))
+
+			conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			conPkg.ClientIdentifier = clientID
+			conPkg.CleanSession = cleanStart
+			Expect(mqtt.WritePacketV5(client, conPkg, props)).To(Succeed())
+
+			p, _, err := mqtt.ReadPacketV5(client)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(BeAssignableToTypeOf(&packets.ConnackPacket{}))
+			return client, p.(*packets.ConnackPacket)
+		}
+
+		connectV5 := func(clientID string) net.Conn {
+			client, _ := connectWithProps(clientID, true, nil)
+			return client
+		}
+
+		// expectSilence expects the broker not to send anything to client for a while
+		expectSilence := func(client net.Conn) {
+			client.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+			_, _, err := mqtt.ReadPacketV5(client)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(net.Error).Timeout()).To(BeTrue())
+		}
+
+		subscribeV5 := func(client net.Conn, topic string) {
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.MessageID = 1
+			subPkg.Topics = []string{topic}
+			subPkg.Qoss = []byte{1}
+			Expect(mqtt.WritePacketV5(client, subPkg, nil)).To(Succeed())
+
+			p, _, err := mqtt.ReadPacketV5(client)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.SubackPacket).ReturnCodes).To(Equal([]byte{1}))
+		}
+
+		publishV5 := func(client net.Conn, topic string, retain bool, props *mqtt.Properties) {
+			pubPkg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pubPkg.TopicName = topic
+			pubPkg.Payload = []byte("hello")
+			pubPkg.Retain = retain
+			Expect(mqtt.WritePacketV5(client, pubPkg, props)).To(Succeed())
+		}
+
+		props := &mqtt.Properties{
+			ResponseTopic:   "matriarch/1.marsara/reply",
+			CorrelationData: []byte{1, 2, 3},
+			User:            []mqtt.UserProperty{{Key: "firmware", Value: "2.1"}},
+		}
+
+		It("forwards properties to MQTT 5 subscribers", func() {
+			subscriber := connectV5("subscriber")
+			defer subscriber.Close()
+			subscribeV5(subscriber, "pylon/#")
+
+			publisher := connectV5("publisher")
+			defer publisher.Close()
+			publishV5(publisher, "pylon/1.marsara/up", false, props)
+
+			p, readProps, err := mqtt.ReadPacketV5(subscriber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).Payload).To(Equal([]byte("hello")))
+			Expect(readProps.ResponseTopic).To(Equal(props.ResponseTopic))
+			Expect(readProps.CorrelationData).To(Equal(props.CorrelationData))
+			Expect(readProps.User).To(Equal(props.User))
+		})
+		It("sends messages of MQTT 5 clients to MQTT 3.1.1 subscribers without properties", func() {
+			brokerSession, subscriber := testutils.Pipe()
+			go broker.HandleConnection(brokerSession)
+			defer subscriber.Close()
+
+			Expect(subscriber.Write(packets.NewControlPacket(packets.Connect))).To(Succeed())
+			_, err := subscriber.Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subPkg.Topics = []string{"pylon/#"}
+			subPkg.Qoss = []byte{0}
+			Expect(subscriber.Write(subPkg)).To(Succeed())
+			_, err = subscriber.Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			publisher := connectV5("publisher")
+			defer publisher.Close()
+			publishV5(publisher, "pylon/1.marsara/up", false, props)
+
+			p, err := subscriber.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).TopicName).To(Equal("pylon/1.marsara/up"))
+			Expect(p.(*packets.PublishPacket).Payload).To(Equal([]byte("hello")))
+		})
+		It("sends messages of MQTT 3.1.1 clients and internal publishers to MQTT 5 subscribers", func() {
+			subscriber := connectV5("subscriber")
+			defer subscriber.Close()
+			subscribeV5(subscriber, "pylon/#")
+
+			go broker.Publish("pylon/1.marsara/up", []byte("hello"))
+
+			p, readProps, err := mqtt.ReadPacketV5(subscriber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).Payload).To(Equal([]byte("hello")))
+			Expect(readProps).To(Equal(&mqtt.Properties{}))
+		})
+		It("does not send expired retained messages", func() {
+			publisher := connectV5("publisher")
+			defer publisher.Close()
+			publishV5(publisher, "pylon/1.marsara/expired", true, &mqtt.Properties{MessageExpiry: mqtt.Uint32(1)})
+			publishV5(publisher, "pylon/1.marsara/kept", true, &mqtt.Properties{MessageExpiry: mqtt.Uint32(60)})
+			time.Sleep(time.Millisecond * 1100)
+
+			subscriber := connectV5("subscriber")
+			defer subscriber.Close()
+			subscribeV5(subscriber, "pylon/#")
+
+			p, readProps, err := mqtt.ReadPacketV5(subscriber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.(*packets.PublishPacket).TopicName).To(Equal("pylon/1.marsara/kept"))
+			Expect(*readProps.MessageExpiry).To(BeNumerically("<=", 59))
+		})
+		It("sends a reason code for each topic filter in UNSUBACK", func() {
+			client := connectV5("client")
+			defer client.Close()
+
+			unsubPkg := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+			unsubPkg.MessageID = 7
+			unsubPkg.Topics = []string{"a", "b"}
+			Expect(mqtt.WritePacketV5(client, unsubPkg, nil)).To(Succeed())
+
+			buf := make([]byte, 7)
+			_, err := client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf).To(Equal([]byte{packets.Unsuback << 4, 5, 0, 7, 0, 0, 0}))
+		})
+		It("sends DISCONNECT with session taken over to a client that connects again", func() {
+			first := connectV5("client")
+			defer first.Close()
+
+			second := connectV5("client")
+			defer second.Close()
+
+			buf := make([]byte, 4)
+			_, err := io.ReadFull(first, buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf).To(Equal([]byte{packets.Disconnect << 4, 2, 0x8E, 0}))
+		})
+		Context("with unacknowledged messages", func() {
+			BeforeEach(func() {
+				config.Config.RetryInterval = time.Millisecond * 50
+			})
+			AfterEach(func() {
+				config.Config.RetryInterval = 0
+			})
+			It("does not resend them before the client reconnects", func() {
+				subscriber := connectV5("subscriber")
+				defer subscriber.Close()
+				subscribeV5(subscriber, "pylon/#")
+
+				go broker.Publish("pylon/1.marsara/up", []byte("hello"))
+
+				p, _, err := mqtt.ReadPacketV5(subscriber)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(p.(*packets.PublishPacket).Dup).To(BeFalse())
+
+				expectSilence(subscriber)
+			})
+		})
+		It("sends no more unacknowledged messages than the receive maximum of the client", func() {
+			subscriber, _ := connectWithProps("subscriber", true, &mqtt.Properties{ReceiveMaximum: mqtt.Uint16(2)})
+			defer subscriber.Close()
+			subscribeV5(subscriber, "pylon/#")
+
+			for i := 0; i < 5; i++ {
+				broker.Publish("pylon/1.marsara/up", []byte("hello"))
+			}
+
+			for i := 0; i < 2; i++ {
+				p, _, err := mqtt.ReadPacketV5(subscriber)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(p.(*packets.PublishPacket).Qos).To(BeEquivalentTo(1))
+			}
+			expectSilence(subscriber)
+		})
+		Describe("session state", func() {
+			// reconnect connects and disconnects the client and returns whether the broker had a session for it
+			reconnect := func(cleanStart bool, expiry uint32) bool {
+				client, connAck := connectWithProps("client", cleanStart, &mqtt.Properties{SessionExpiry: mqtt.Uint32(expiry)})
+				client.Close()
+				// wait for the broker to remove the session
+				time.Sleep(time.Millisecond * 10)
+				return connAck.SessionPresent
+			}
+
+			It("resumes the session without clean start", func() {
+				Expect(reconnect(false, 60)).To(BeFalse())
+				Expect(reconnect(false, 60)).To(BeTrue())
+			})
+			It("keeps the session with clean start and a session expiry interval", func() {
+				Expect(reconnect(true, 60)).To(BeFalse())
+				Expect(reconnect(false, 60)).To(BeTrue())
+			})
+			It("resumes the session without clean start and a session expiry interval of 0, but does not keep it", func() {
+				Expect(reconnect(false, 60)).To(BeFalse())
+				Expect(reconnect(false, 0)).To(BeTrue())
+				Expect(reconnect(false, 0)).To(BeFalse())
+			})
+			It("discards the session with clean start and a session expiry interval of 0", func() {
+				Expect(reconnect(false, 60)).To(BeFalse())
+				Expect(reconnect(true, 0)).To(BeFalse())
+				Expect(reconnect(false, 0)).To(BeFalse())
+			})
+		})
+		Context("with a short session expiry interval of the broker", func() {
+			BeforeEach(func() {
+				config.Config.SessionExpiry = time.Millisecond * 10
+				broker = mqtt.NewBroker(false)
+			})
+			AfterEach(func() {
+				config.Config.SessionExpiry = 0
+			})
+			It("keeps the session for the session expiry interval of the client", func() {
+				props := &mqtt.Properties{SessionExpiry: mqtt.Uint32(60)}
+
+				client, _ := connectWithProps("client", false, props)
+				subscribeV5(client, "pylon/#")
+				client.Close()
+				time.Sleep(time.Millisecond * 50)
+
+				client, connAck := connectWithProps("client", false, props)
+				defer client.Close()
+				Expect(connAck.SessionPresent).To(BeTrue())
+			})
+		})
+		It("closes the connection on topic aliases", func() {
+			client := connectV5("client")
+			defer client.Close()
+
+			publishV5(client, "pylon/1.marsara/up", false, &mqtt.Properties{TopicAlias: mqtt.Uint16(1)})
+
+			_, _, err := mqtt.ReadPacketV5(client)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
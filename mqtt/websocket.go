@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	bugsnag "github.com/bugsnag/bugsnag-go"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketSubprotocol is the subprotocol clients must request during the WebSocket handshake
+const WebSocketSubprotocol = "mqtt"
+
+// WebSocketServer accepts MQTT connections over WebSocket
+type WebSocketServer struct {
+	bind        string
+	tlsConfig   *tls.Config
+	sessHandler SessionHandler
+	upgrader    websocket.Upgrader
+	httpServer  *http.Server
+	sessions    *sessionGroup
+}
+
+// NewWebSocketServer instantiates a new server that accepts WebSocket connections on the address passed in "bind".
+// If tlsConfig is not nil, the server only accepts TLS connections.
+func NewWebSocketServer(bind string, tlsConfig *tls.Config, sessHandler SessionHandler) *WebSocketServer {
+	if sessHandler == nil {
+		return nil
+	}
+
+	s := &WebSocketServer{
+		bind:        bind,
+		tlsConfig:   tlsConfig,
+		sessHandler: sessHandler,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{WebSocketSubprotocol},
+			// browser clients are served from a different origin and authenticate via CONNECT
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		sessions: newSessionGroup(),
+	}
+	s.httpServer = &http.Server{Handler: s}
+	return s
+}
+
+// Run accepts connections until Shutdown is called, in which case it returns ErrServerClosed.
+// Any other error means the server could not listen on its address.
+func (s *WebSocketServer) Run() error {
+	listener, err := net.Listen("tcp", s.bind)
+	if err != nil {
+		notifyBugsnagSync(err, "spire:createListener", bugsnag.MetaData{"Listen": {"Bind": s.bind}})
+		return err
+	}
+
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+		log.Println("listening for WebSocket connections on", s.bind, "(TLS)")
+	} else {
+		log.Println("listening for WebSocket connections on", s.bind)
+	}
+
+	if err = s.httpServer.Serve(listener); err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// SetLimits restricts the connections the server accepts. It must be called before Run.
+func (s *WebSocketServer) SetLimits(limits Limits) {
+	s.sessions.setLimits(limits)
+}
+
+// Shutdown stops accepting connections and disconnects clients like Server.Shutdown
+func (s *WebSocketServer) Shutdown(ctx context.Context) error {
+	sessions := s.sessions.close()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.sessions.disconnect(ctx, sessions)
+}
+
+// ServeHTTP implements http.Handler
+func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already responded with an error
+		return
+	}
+
+	if conn.Subprotocol() != WebSocketSubprotocol {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "subprotocol mqtt required"),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	s.sessions.serve(NewWebSocketConn(conn), s.sessHandler)
+}
+
+// WebSocketConn adapts a WebSocket connection to net.Conn. MQTT packets are sent in binary messages.
+type WebSocketConn struct {
+	*websocket.Conn
+
+	r  io.Reader
+	wl sync.Mutex
+}
+
+// NewWebSocketConn ...
+func NewWebSocketConn(conn *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{Conn: conn}
+}
+
+// Read reads from the current binary message and continues with the next one when it is exhausted
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			messageType, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+
+			if messageType != websocket.BinaryMessage {
+				return 0, errors.New("received a WebSocket message that is not binary")
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write sends b in a single binary message
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetWriteDeadline ...
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetDeadline ...
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,85 @@
+package mqtt_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/mqtt"
+)
+
+var _ = Describe("WebSocket", func() {
+
+	var broker *mqtt.Broker
+	var server *httptest.Server
+	var subprotocols []string
+	var client *mqtt.Session
+	var dialErr error
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false)
+		server = httptest.NewServer(mqtt.NewWebSocketServer("", nil, broker.HandleConnection))
+		subprotocols = []string{mqtt.WebSocketSubprotocol}
+	})
+	JustBeforeEach(func() {
+		dialer := websocket.Dialer{Subprotocols: subprotocols}
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		var conn *websocket.Conn
+		conn, _, dialErr = dialer.Dial(url, nil)
+		if dialErr == nil {
+			client = mqtt.NewSession(mqtt.NewWebSocketConn(conn), time.Second)
+		}
+	})
+	AfterEach(func() {
+		if client != nil {
+			client.Close()
+		}
+		server.Close()
+	})
+	It("handles MQTT sessions", func() {
+		Expect(dialErr).NotTo(HaveOccurred())
+
+		conPkg := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		conPkg.ClientIdentifier = "matriarch-ui"
+		Expect(client.Write(conPkg)).NotTo(HaveOccurred())
+
+		p, err := client.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(BeAssignableToTypeOf(&packets.ConnackPacket{}))
+
+		subPkg := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subPkg.Topics = []string{"pylon/+/up"}
+		subPkg.Qoss = []byte{0}
+		subPkg.MessageID = 1
+		Expect(client.Write(subPkg)).NotTo(HaveOccurred())
+
+		p, err = client.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(BeAssignableToTypeOf(&packets.SubackPacket{}))
+
+		broker.Publish("pylon/1.marsara/up", []byte(`{"state":"up"}`))
+
+		p, err = client.Read()
+		Expect(err).NotTo(HaveOccurred())
+
+		pubPkg := p.(*packets.PublishPacket)
+		Expect(pubPkg.TopicName).To(Equal("pylon/1.marsara/up"))
+		Expect(string(pubPkg.Payload)).To(Equal(`{"state":"up"}`))
+	})
+	Context("without the mqtt subprotocol", func() {
+		BeforeEach(func() {
+			subprotocols = nil
+		})
+		It("closes the connection", func() {
+			Expect(dialErr).NotTo(HaveOccurred())
+
+			_, err := client.Read()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
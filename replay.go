@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/superscale/spire/capture"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/devices/ota"
+	"github.com/superscale/spire/devices/ping"
+	"github.com/superscale/spire/devices/rpc"
+	"github.com/superscale/spire/devices/stations"
+	"github.com/superscale/spire/devices/up"
+	"github.com/superscale/spire/mqtt"
+)
+
+const replayUsage = `usage: spire replay [-speed N] [-filter FILTER] CAPTURE...
+
+Feeds capture files written with SPIRE_CAPTURE_FILE into a broker with the message handlers
+registered and prints the messages published to topics matching the filter. Rotated files of
+a capture (CAPTURE.1, CAPTURE.2, ...) are replayed first. Handlers with external side effects,
+exception and sentry, are left out. Only SPIRE_SLASH_PREFIX_TOPICS and SPIRE_RPC_TIMEOUT are read
+from the environment.
+
+`
+
+// replayConfig is the part of the configuration used by the replayed handlers.
+// The other settings keep their defaults, so that replay needs none of the settings of the server.
+type replayConfig struct {
+	SlashPrefixTopics bool          `env:"SPIRE_SLASH_PREFIX_TOPICS"  envDefault:"true"`
+	RPCTimeout        time.Duration `env:"SPIRE_RPC_TIMEOUT"  envDefault:"30s"`
+}
+
+// replayHandlers are the message handlers without external side effects
+var replayHandlers = []registerFn{
+	deviceInfo.Register,
+	ota.Register,
+	ping.Register,
+	rpc.Register,
+	up.Register,
+	stations.Register,
+}
+
+// replay runs the "spire replay" command
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "speed relative to the capture. 0 replays as fast as possible")
+	filter := flags.String("filter", "#", "print messages published to topics matching this filter")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg := new(replayConfig)
+	if err := env.Parse(cfg); err != nil {
+		log.Fatal(err)
+	}
+	config.Config.SlashPrefixTopics = cfg.SlashPrefixTopics
+	config.Config.RPCTimeout = cfg.RPCTimeout
+
+	broker := mqtt.NewBroker(cfg.SlashPrefixTopics)
+	formations := devices.NewFormationMap()
+	for _, register := range replayHandlers {
+		register(broker, formations)
+	}
+	broker.Subscribe(*filter, messagePrinter{})
+
+	for _, path := range flags.Args() {
+		files := capture.Files(path)
+		if len(files) == 0 {
+			log.Fatalf("no capture found at %s", path)
+		}
+
+		for _, name := range files {
+			n, err := replayFile(broker, name, *speed)
+			if err != nil {
+				log.Fatalf("error while replaying %s: %v", name, err)
+			}
+			log.Printf("replayed %d messages from %s", n, name)
+		}
+	}
+}
+
+func replayFile(broker *mqtt.Broker, name string, speed float64) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return capture.Replay(broker, capture.NewReader(f), speed)
+}
+
+// messagePrinter writes the messages it receives to stdout
+type messagePrinter struct{}
+
+// HandleMessage implements mqtt.Subscriber
+func (messagePrinter) HandleMessage(topic string, message interface{}) error {
+	payload, ok := message.([]byte)
+	if !ok {
+		var err error
+		if payload, err = json.Marshal(message); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%s %s\n", topic, payload)
+	return nil
+}
@@ -1,7 +1,14 @@
 package testutils
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"math/big"
 	"net"
 	"sync"
 	"time"
@@ -17,6 +24,81 @@ func Pipe() (*mqtt.Session, *mqtt.Session) {
 	return mqtt.NewSession(a, t), mqtt.NewSession(b, t)
 }
 
+// TCPPipe returns a pair of sessions connected over TCP on the loopback interface
+func TCPPipe() (*mqtt.Session, *mqtt.Session) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	b, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	a, err := listener.Accept()
+	if err != nil {
+		panic(err)
+	}
+
+	t := time.Second * 1
+	return mqtt.NewSession(a, t), mqtt.NewSession(b, t)
+}
+
+// TLSPipe returns a pair of sessions connected over TLS. The client presents a
+// self-signed certificate for commonName which the server accepts as its own CA.
+func TLSPipe(commonName string) (*mqtt.Session, *mqtt.Session) {
+	cert := Certificate(commonName)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+
+	a, b := net.Pipe()
+	t := time.Second * 1
+	return mqtt.NewSession(tls.Server(a, serverConfig), t), mqtt.NewSession(tls.Client(b, clientConfig), t)
+}
+
+// Certificate creates a self-signed certificate for commonName that can be used by clients and servers
+func Certificate(commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
 // PubSubRecorder ...
 type PubSubRecorder struct {
 	Topics   []string